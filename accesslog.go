@@ -0,0 +1,33 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Reporting each request to Server.OnRequest.
+
+package icap
+
+import "time"
+
+// RequestInfo describes how a request was answered, for
+// Server.OnRequest. The client's address, the method, and the service
+// are in the Request.
+type RequestInfo struct {
+	Status           int           // the status code of the response
+	BytesRead        int64         // bytes of the request read from the connection, including the body
+	BytesWritten     int64         // bytes written to the connection, including any "100 Continue"
+	BodyBytesWritten int64         // bytes of the encapsulated body in the response, before chunked encoding
+	Start            time.Time     // when the request line arrived
+	Duration         time.Duration // from Start until the response was sent and the body read
+}
+
+// bytesRead returns the number of bytes read from the connection and
+// consumed so far, leaving out any that are buffered but not yet used.
+func (c *conn) bytesRead() int64 {
+	return c.cr.total - int64(c.buf.Reader.Buffered())
+}
+
+// bytesWritten returns the number of bytes written to the connection
+// so far, including any that are still buffered.
+func (c *conn) bytesWritten() int64 {
+	return c.cw.n + int64(c.buf.Writer.Buffered())
+}
@@ -0,0 +1,75 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOnRequest(t *testing.T) {
+	respmod := "RESPMOD icap://icap-server.net/scan ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: res-hdr=0, res-body=45\r\n" +
+		"\r\n" +
+		"HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"5\r\n" +
+		"hello\r\n" +
+		"0\r\n" +
+		"\r\n"
+	options := "OPTIONS icap://icap-server.net/scan ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"\r\n"
+
+	var mu sync.Mutex
+	var methods []string
+	var infos []RequestInfo
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.Header().Set("Date", "Mon, 10 Jan 2000  09:55:21 GMT")
+			if req.Method == "OPTIONS" {
+				w.WriteHeader(404, nil, false)
+				return
+			}
+			w.WriteHeader(200, req.Response, true)
+			io.Copy(w, req.Response.Body)
+		}),
+		OnRequest: func(req *Request, info *RequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			methods = append(methods, req.Method)
+			infos = append(infos, *info)
+		},
+	}
+	response := serverRoundTrip(srv, respmod+options, t)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(infos) != 2 {
+		t.Fatalf("OnRequest called %d times (should be 2)", len(infos))
+	}
+	checkString("First method", methods[0], "RESPMOD", t)
+	checkString("Second method", methods[1], "OPTIONS", t)
+	if infos[0].Status != 200 || infos[1].Status != 404 {
+		t.Errorf("statuses are %d and %d (should be 200 and 404)", infos[0].Status, infos[1].Status)
+	}
+	if infos[0].BytesRead != int64(len(respmod)) || infos[1].BytesRead != int64(len(options)) {
+		t.Errorf("BytesRead are %d and %d (should be %d and %d)", infos[0].BytesRead, infos[1].BytesRead, len(respmod), len(options))
+	}
+	first := strings.Index(response, "ICAP/1.0 404")
+	if first < 0 {
+		t.Fatalf("Response is %s (should end with a 404)", response)
+	}
+	if infos[0].BytesWritten != int64(first) || infos[1].BytesWritten != int64(len(response)-first) {
+		t.Errorf("BytesWritten are %d and %d (should be %d and %d)", infos[0].BytesWritten, infos[1].BytesWritten, first, len(response)-first)
+	}
+	if infos[0].Start.IsZero() || infos[0].Duration < 0 {
+		t.Errorf("Start is %v and Duration %v", infos[0].Start, infos[0].Duration)
+	}
+}
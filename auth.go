@@ -0,0 +1,57 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Identifying the user on whose behalf a request was made.
+
+package icap
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// ErrNoAuthenticatedUser is returned by Request.AuthenticatedUser when
+// the request has no X-Authenticated-User header.
+var ErrNoAuthenticatedUser = errors.New("icap: no X-Authenticated-User header")
+
+// An AuthUser is the identity of the user that a proxy authenticated.
+type AuthUser struct {
+	Scheme   string // the authentication scheme, such as "basic"; may be empty
+	Username string
+}
+
+// AuthenticatedUser decodes the X-Authenticated-User header, which the
+// proxy sends as the base64 encoding of "scheme://username" (for
+// example, "YmFzaWM6Ly9hbGljZQ==" for "basic://alice"). Standard and
+// URL-safe base64, with or without padding, are accepted. If the
+// decoded value has no scheme, only Username is set.
+func (req *Request) AuthenticatedUser() (AuthUser, error) {
+	v := strings.TrimSpace(req.Header.Get("X-Authenticated-User"))
+	if v == "" {
+		return AuthUser{}, ErrNoAuthenticatedUser
+	}
+
+	var decoded []byte
+	var err error
+	for _, enc := range []*base64.Encoding{
+		base64.StdEncoding,
+		base64.RawStdEncoding,
+		base64.URLEncoding,
+		base64.RawURLEncoding,
+	} {
+		if decoded, err = enc.DecodeString(v); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return AuthUser{}, &badStringError{"malformed X-Authenticated-User: header", v}
+	}
+
+	s := string(decoded)
+	if i := strings.Index(s, "://"); i != -1 {
+		return AuthUser{Scheme: s[:i], Username: s[i+3:]}, nil
+	}
+	return AuthUser{Username: s}, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"net/textproto"
+	"testing"
+)
+
+func TestAuthenticatedUser(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		user   AuthUser
+	}{
+		{"YmFzaWM6Ly9hbGljZQ==", AuthUser{"basic", "alice"}},
+		{"YmFzaWM6Ly9hbGljZQ", AuthUser{"basic", "alice"}},
+		{"V2luTlQ6Ly9DT1JQL2JvYg==", AuthUser{"WinNT", "CORP/bob"}},
+		{"TG9jYWw6Ly9-Pz8-", AuthUser{"Local", "~??>"}},
+		{"Y2Fyb2w=", AuthUser{"", "carol"}},
+	} {
+		req := &Request{Header: textproto.MIMEHeader{}}
+		req.Header.Set("X-Authenticated-User", c.header)
+		user, err := req.AuthenticatedUser()
+		if err != nil {
+			t.Errorf("error decoding %s: %v", c.header, err)
+			continue
+		}
+		if user != c.user {
+			t.Errorf("%s decoded as %+v (should be %+v)", c.header, user, c.user)
+		}
+	}
+
+	req := &Request{Header: textproto.MIMEHeader{}}
+	if _, err := req.AuthenticatedUser(); err != ErrNoAuthenticatedUser {
+		t.Errorf("error for missing header is %v (should be ErrNoAuthenticatedUser)", err)
+	}
+	req.Header.Set("X-Authenticated-User", "not base64!")
+	if _, err := req.AuthenticatedUser(); err == nil {
+		t.Error("no error for malformed header")
+	}
+}
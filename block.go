@@ -0,0 +1,44 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Block pages, sent in place of the page the user asked for.
+
+package icap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// BlockResponse returns an HTTP response with status code, holding
+// body, of type contentType, such as a page explaining why a download
+// was blocked. Its Content-Length header and ContentLength field give
+// the length of body. To send it, in answer to either REQMOD or
+// RESPMOD, call BufferBody, so that the Content-Length is sent, then
+// SatisfyWithResponse, and copy its Body:
+//
+//	resp := icap.BlockResponse(http.StatusForbidden, page, "text/html; charset=utf-8")
+//	icap.BufferBody(w)
+//	icap.SatisfyWithResponse(w, resp, true)
+//	io.Copy(w, resp.Body)
+func BlockResponse(code int, body []byte, contentType string) *http.Response {
+	resp := &http.Response{
+		Status:        strconv.Itoa(code) + " " + http.StatusText(code),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+	}
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Set("Cache-Control", "no-store")
+	resp.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	return resp
+}
@@ -0,0 +1,64 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const blockRequest = "RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+	"Host: icap-server.net\r\n" +
+	"Encapsulated: res-hdr=0, res-body=45\r\n" +
+	"\r\n" +
+	"HTTP/1.1 200 OK\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"5\r\n" +
+	"virus\r\n" +
+	"0\r\n" +
+	"\r\n"
+
+func TestBlockResponse(t *testing.T) {
+	page := []byte("<h1>Blocked</h1>\n")
+	resp := BlockResponse(http.StatusForbidden, page, "text/html; charset=utf-8")
+	checkString("Status", resp.Status, "403 Forbidden", t)
+	checkString("Content-Length", resp.Header.Get("Content-Length"), "17", t)
+	if resp.ContentLength != int64(len(page)) {
+		t.Errorf("ContentLength is %d (should be %d)", resp.ContentLength, len(page))
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	checkString("Body", string(body), string(page), t)
+
+	response := roundTrip(blockRequest, HandlerFunc(func(w ResponseWriter, req *Request) {
+		resp := BlockResponse(http.StatusForbidden, page, "text/html; charset=utf-8")
+		BufferBody(w)
+		SatisfyWithResponse(w, resp, true)
+		io.Copy(w, resp.Body)
+	}), t)
+	if !strings.Contains(response, "\r\n\r\nHTTP/1.1 403 Forbidden\r\n") {
+		t.Errorf("Response is %s (should have an HTTP 403)", response)
+	}
+	if strings.Count(response, "Content-Length:") != 1 || !strings.Contains(response, "\r\nContent-Length: 17\r\n") {
+		t.Errorf("Response is %s (should have one Content-Length: 17)", response)
+	}
+	if !strings.HasSuffix(response, "\r\n11\r\n<h1>Blocked</h1>\n\r\n0\r\n\r\n") {
+		t.Errorf("Response is %s (should end with the block page)", response)
+	}
+}
+
+func TestChangedStatusCode(t *testing.T) {
+	// Changing StatusCode makes the old Status text stale.
+	response := roundTrip(blockRequest, HandlerFunc(func(w ResponseWriter, req *Request) {
+		req.Response.StatusCode = http.StatusForbidden
+		SatisfyWithResponse(w, req.Response, false)
+	}), t)
+	if !strings.Contains(response, "\r\n\r\nHTTP/1.1 403 Forbidden\r\n") {
+		t.Errorf("Response is %s (should have an HTTP 403)", response)
+	}
+}
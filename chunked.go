@@ -9,9 +9,12 @@ package icap
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
 )
 
 const maxLineLength = 4096 // assumed <= bufio.defaultBufSize
@@ -24,7 +27,7 @@ var errLineTooLong = errors.New("header line too long")
 //
 // NewChunkedReader is not needed by normal applications. The http package
 // automatically decodes chunking when reading response bodies.
-func newChunkedReader(r io.Reader) io.Reader {
+func newChunkedReader(r io.Reader) *chunkedReader {
 	br, ok := r.(*bufio.Reader)
 	if !ok {
 		br = bufio.NewReader(r)
@@ -35,8 +38,14 @@ func newChunkedReader(r io.Reader) io.Reader {
 type chunkedReader struct {
 	r   *bufio.Reader
 	n   uint64 // unread bytes in chunk
+	ext string // extension of the current chunk, such as "ieof"
 	err error
 	buf [2]byte
+
+	// If trailer is not nil, the fields of the trailer after the last
+	// chunk are added to the header it points to, which is created if
+	// it is nil. Otherwise they are discarded.
+	trailer *http.Header
 }
 
 func (cr *chunkedReader) beginChunk() {
@@ -46,15 +55,44 @@ func (cr *chunkedReader) beginChunk() {
 	if cr.err != nil {
 		return
 	}
+	line, cr.ext = splitChunkExtension(line)
 	cr.n, cr.err = parseHexUint(line)
 	if cr.err != nil {
 		return
 	}
 	if cr.n == 0 {
+		// Consume the trailer and the blank line that ends the body,
+		// so that whatever follows can be read from cr.r.
+		for {
+			line, cr.err = readLine(cr.r)
+			if cr.err != nil {
+				return
+			}
+			if len(line) == 0 {
+				break
+			}
+			cr.addTrailer(line)
+		}
 		cr.err = io.EOF
 	}
 }
 
+// addTrailer adds line, a field of the trailer, to cr.trailer.
+func (cr *chunkedReader) addTrailer(line []byte) {
+	if cr.trailer == nil {
+		return
+	}
+	colon := bytes.IndexByte(line, ':')
+	if colon <= 0 {
+		return
+	}
+	if *cr.trailer == nil {
+		*cr.trailer = make(http.Header)
+	}
+	key := http.CanonicalHeaderKey(string(bytes.TrimSpace(line[:colon])))
+	cr.trailer.Add(key, string(bytes.TrimSpace(line[colon+1:])))
+}
+
 func (cr *chunkedReader) Read(b []uint8) (n int, err error) {
 	if cr.err != nil {
 		return 0, cr.err
@@ -115,7 +153,8 @@ func isASCIISpace(b byte) bool {
 
 // NewChunkedWriter returns a new chunkedWriter that translates writes into HTTP
 // "chunked" format before writing them to w. Closing the returned chunkedWriter
-// sends the final 0-length chunk that marks the end of the stream.
+// sends the final 0-length chunk that marks the end of the stream, but not
+// the blank line (or trailer) that follows it; the caller writes that.
 //
 // NewChunkedWriter is not needed by normal applications. The http
 // package adds chunking automatically if handlers don't set a
@@ -123,13 +162,18 @@ func isASCIISpace(b byte) bool {
 // would result in double chunking or chunking with a Content-Length
 // length, both of which are wrong.
 func NewChunkedWriter(w io.Writer) io.WriteCloser {
-	return &chunkedWriter{w}
+	return &chunkedWriter{Wire: w}
 }
 
 // Writing to chunkedWriter translates to writing in HTTP chunked Transfer
 // Encoding wire format to the underlying Wire chunkedWriter.
 type chunkedWriter struct {
 	Wire io.Writer
+
+	// lastExt is the chunk extension, if any, for the zero-length
+	// chunk written by finish, and trailer the trailer that follows it.
+	lastExt string
+	trailer http.Header
 }
 
 // Write the contents of data as one chunk to Wire.
@@ -157,11 +201,60 @@ func (cw *chunkedWriter) Write(data []byte) (n int, err error) {
 	return
 }
 
+// Close writes the zero-length chunk that ends the body, without the
+// blank line that ends the message, as NewChunkedWriter documents.
 func (cw *chunkedWriter) Close() error {
 	_, err := io.WriteString(cw.Wire, "0\r\n")
 	return err
 }
 
+// finish ends the body completely: it writes the zero-length chunk
+// with lastExt, the trailer, and the blank line.
+func (cw *chunkedWriter) finish() error {
+	if cw.lastExt == "" && len(cw.trailer) == 0 {
+		_, err := io.WriteString(cw.Wire, "0\r\n\r\n")
+		return err
+	}
+	var b bytes.Buffer
+	b.WriteString("0")
+	if cw.lastExt != "" {
+		b.WriteString("; " + cw.lastExt)
+	}
+	b.WriteString("\r\n")
+	cw.trailer.Write(&b)
+	b.WriteString("\r\n")
+	_, err := cw.Wire.Write(b.Bytes())
+	return err
+}
+
+// splitChunkExtension separates a chunk-size line into the size and the
+// chunk extension (without the semicolon).
+func splitChunkExtension(line []byte) (size []byte, ext string) {
+	semi := bytes.IndexByte(line, ';')
+	if semi == -1 {
+		return line, ""
+	}
+	return trimTrailingWhitespace(line[:semi]), string(bytes.TrimSpace(line[semi+1:]))
+}
+
+// hasChunkExtension reports whether the chunk extensions in ext include name.
+func hasChunkExtension(ext, name string) bool {
+	for _, e := range strings.Split(ext, ";") {
+		e = strings.TrimSpace(e)
+		if eq := strings.IndexByte(e, '='); eq != -1 {
+			e = strings.TrimSpace(e[:eq])
+		}
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isHexDigit(b byte) bool {
+	return '0' <= b && b <= '9' || 'a' <= b && b <= 'f' || 'A' <= b && b <= 'F'
+}
+
 func parseHexUint(v []byte) (n uint64, err error) {
 	for _, b := range v {
 		n <<= 4
@@ -0,0 +1,117 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Reading an encapsulated body chunk by chunk, with chunk extensions.
+
+package icap
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// A ChunkReader reads the encapsulated body of a request one chunk at
+// a time, as the client sent it, for handlers that need the chunk
+// extensions. Next moves to the next chunk, and Read reads its data.
+//
+// The preview, if any, has already been read by the time the handler
+// is called, so it is returned as a single chunk without an extension;
+// the chunk that ends the preview is not returned, unless it ends the
+// whole body ("0; ieof"). Moving past the preview sends "100 Continue".
+type ChunkReader struct {
+	req     *Request
+	started bool
+	cur     io.Reader      // the data of the current chunk
+	cr      *chunkedReader // the chunks after the preview
+	done    bool           // the last chunk has been returned
+}
+
+// BodyChunks returns a ChunkReader for req's body. It reads from the
+// same stream as req.Body(), so a handler should use one or the other.
+// For a request without a body, Next returns io.EOF straight away.
+func (req *Request) BodyChunks() *ChunkReader {
+	return &ChunkReader{req: req}
+}
+
+// Next moves to the next chunk, skipping whatever is left of the
+// current one, and returns its extension (the text after the semicolon
+// in the chunk-size line) and its size. The last chunk has size 0; its
+// extension may carry information such as "ieof". After the last
+// chunk, Next returns io.EOF.
+func (r *ChunkReader) Next() (ext string, size int64, err error) {
+	if r.cur != nil {
+		if _, err = io.Copy(ioutil.Discard, r.cur); err != nil {
+			return "", 0, err
+		}
+		r.cur = nil
+	}
+	if r.done {
+		return "", 0, io.EOF
+	}
+
+	if !r.started {
+		r.started = true
+		req := r.req
+		switch {
+		case req.cont != nil, req.PreviewEOF:
+			if len(req.Preview) > 0 {
+				r.cur = bytes.NewReader(req.Preview)
+				return "", int64(len(req.Preview)), nil
+			}
+		case req.chunks != nil:
+			r.cr = req.chunks
+		default:
+			r.done = true
+			return "", 0, io.EOF
+		}
+	}
+
+	if r.cr == nil {
+		req := r.req
+		if req.PreviewEOF {
+			r.done = true
+			return req.PreviewExtension, 0, nil
+		}
+		if err = req.cont.start(); err != nil {
+			return "", 0, err
+		}
+		r.cr = req.cont.cr
+	}
+
+	if r.cr.err != nil {
+		return "", 0, r.cr.err
+	}
+	r.cr.beginChunk()
+	if r.cr.err == io.EOF {
+		r.done = true
+		return r.cr.ext, 0, nil
+	}
+	if r.cr.err != nil {
+		return "", 0, r.cr.err
+	}
+	r.cur = chunkData{r.cr}
+	return r.cr.ext, int64(r.cr.n), nil
+}
+
+// Read reads from the current chunk. It returns io.EOF at the end of
+// the chunk, and before the first call to Next.
+func (r *ChunkReader) Read(p []byte) (n int, err error) {
+	if r.cur == nil {
+		return 0, io.EOF
+	}
+	return r.cur.Read(p)
+}
+
+// chunkData reads what is left of the current chunk from cr.
+type chunkData struct {
+	cr *chunkedReader
+}
+
+func (d chunkData) Read(p []byte) (n int, err error) {
+	if d.cr.n == 0 {
+		return 0, io.EOF
+	}
+	return d.cr.Read(p)
+}
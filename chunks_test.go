@@ -0,0 +1,105 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// readChunks reads all the chunks from r, and describes each one as
+// "ext:data".
+func readChunks(r *ChunkReader) ([]string, error) {
+	var chunks []string
+	for {
+		ext, size, err := r.Next()
+		if err == io.EOF {
+			return chunks, nil
+		}
+		if err != nil {
+			return chunks, err
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return chunks, err
+		}
+		if int64(len(data)) != size {
+			return chunks, fmt.Errorf("chunk with %q has %d bytes (size %d)", ext, len(data), size)
+		}
+		chunks = append(chunks, ext+":"+string(data))
+	}
+}
+
+func TestBodyChunks(t *testing.T) {
+	const head = "RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: res-hdr=0, res-body=45\r\n"
+	const httpHeader = "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n"
+	for _, c := range []struct {
+		preview, body string
+		chunks        []string
+		continued     bool
+	}{
+		{
+			"",
+			"5; foo=1\r\nhello\r\n6\r\n world\r\n0; bar\r\n\r\n",
+			[]string{"foo=1:hello", ": world", "bar:"},
+			false,
+		},
+		{
+			"Preview: 5\r\n",
+			"5\r\nhello\r\n0\r\n\r\n" + "6; foo\r\n world\r\n0\r\n\r\n",
+			[]string{":hello", "foo: world", ":"},
+			true,
+		},
+		{
+			"Preview: 10\r\n",
+			"5\r\nhello\r\n0; ieof\r\n\r\n",
+			[]string{":hello", "ieof:"},
+			false,
+		},
+		{
+			"Preview: 0\r\n",
+			"0\r\n\r\n" + "5\r\nhello\r\n0\r\n\r\n",
+			[]string{":hello", ":"},
+			true,
+		},
+	} {
+		request := head + c.preview + "\r\n" + httpHeader + c.body
+		out := new(strings.Builder)
+		bw := bufio.NewWriter(out)
+		req, err := ReadRequest(bufio.NewReadWriter(bufio.NewReader(strings.NewReader(request)), bw))
+		if err != nil {
+			t.Fatalf("error reading request: %v", err)
+		}
+		chunks, err := readChunks(req.BodyChunks())
+		if err != nil {
+			t.Errorf("error reading chunks of %q: %v", c.body, err)
+		}
+		if fmt.Sprint(chunks) != fmt.Sprint(c.chunks) {
+			t.Errorf("chunks of %q are %q (should be %q)", c.body, chunks, c.chunks)
+		}
+		bw.Flush()
+		if continued := out.Len() > 0; continued != c.continued {
+			t.Errorf("100 Continue sent for %q: %v (should be %v)", c.body, continued, c.continued)
+		}
+	}
+}
+
+func TestBodyChunksNoBody(t *testing.T) {
+	req, err := ReadRequest(newTestReadWriter(reqmodNoBody))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	if _, _, err := req.BodyChunks().Next(); err != io.EOF {
+		t.Errorf("Next returned %v for a request with no body (should be io.EOF)", err)
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The client side: sending requests to an ICAP server.
+
+package icap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// NewRequest returns a Request for method (REQMOD, RESPMOD, or OPTIONS)
+// on the ICAP service at urlStr, such as "icap://icap.example.com/scan",
+// to be sent with a Client. httpReq and httpResp are the HTTP messages to
+// encapsulate; either may be nil. The body sent is httpReq.Body for
+// REQMOD, or httpResp.Body for RESPMOD, if it is not nil. An OPTIONS
+// request can be given an opt-body with SetOptBody.
+func NewRequest(method, urlStr string, httpReq *http.Request, httpResp *http.Response) (*Request, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	req := &Request{
+		Method:      method,
+		RawURL:      urlStr,
+		URL:         u,
+		Proto:       "ICAP/1.0",
+		Header:      make(textproto.MIMEHeader),
+		PreviewSize: -1,
+		Request:     httpReq,
+		Response:    httpResp,
+	}
+	req.Header.Set("Host", u.Host)
+
+	switch {
+	case method == "REQMOD" && httpReq != nil && httpReq.Body != nil && httpReq.Body != http.NoBody:
+		req.bodySection = "req-body"
+		req.body = httpReq.Body
+	case method == "RESPMOD" && httpResp != nil && httpResp.Body != nil && httpResp.Body != http.NoBody:
+		req.bodySection = "res-body"
+		req.body = httpResp.Body
+	case httpReq != nil || httpResp != nil:
+		req.bodySection = "null-body"
+	}
+	return req, nil
+}
+
+// A Response represents an ICAP response received by a Client.
+type Response struct {
+	Status     string               // e.g. "200 OK"
+	StatusCode int                  // e.g. 200
+	Proto      string               // e.g. "ICAP/1.0"
+	Header     textproto.MIMEHeader // the ICAP header
+
+	// Request and Response are the encapsulated HTTP messages, if any:
+	// for REQMOD, the adapted request, or a response that satisfies it;
+	// for RESPMOD, the adapted response. The Trailer of the one that
+	// carries the body is filled in once the body has been read to EOF.
+	Request  *http.Request
+	Response *http.Response
+
+	bodySection string        // the last Encapsulated section
+	body        io.ReadCloser // the encapsulated body, if any
+}
+
+// Body returns the encapsulated body, whichever section carried it.
+// If there is no body, it returns http.NoBody.
+func (resp *Response) Body() io.ReadCloser {
+	if resp.body == nil {
+		return http.NoBody
+	}
+	return resp.body
+}
+
+// A Client sends ICAP requests over a single connection to a server.
+// It sends one request at a time; the body of each response must be
+// read to the end before the next request is sent. A Client is not safe
+// for concurrent use.
+type Client struct {
+	conn    net.Conn
+	buf     *bufio.ReadWriter
+	writing chan error // receives the result of writing the last request
+}
+
+// Dial connects to the ICAP server at the TCP address addr, such as
+// "icap.example.com:1344".
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// NewClient returns a Client that sends requests over conn.
+func NewClient(conn net.Conn) *Client {
+	return &Client{
+		conn: conn,
+		buf:  bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+	}
+}
+
+// Close closes the connection. If the body of the last request is still
+// being sent, because the server answered before reading all of it,
+// Close waits for that to stop, so the caller may then use whatever the
+// body was being read from.
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	if c.writing != nil {
+		<-c.writing
+		c.writing = nil
+	}
+	return err
+}
+
+// Do sends req and reads the response. The Encapsulated header is
+// computed from the HTTP messages in req. If req has a Preview header,
+// Do sends the preview first (see Request.WriteTo), and the rest of the
+// body only if the server answers "100 Continue"; if it answers with a
+// final response straight away, such as 204 No Modifications, the rest
+// of the body is not read at all.
+func (c *Client) Do(req *Request) (*Response, error) {
+	if c.writing != nil {
+		err := <-c.writing
+		c.writing = nil
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The request is written in the background, so that the server can
+	// start its response while the rest of a large body is on its way,
+	// without either side blocking the other.
+	cont := make(chan bool, 1)
+	c.writing = make(chan error, 1)
+	go func(done chan<- error) {
+		done <- c.writeRequest(req, cont)
+	}(c.writing)
+
+	answered := false
+	defer func() {
+		if !answered {
+			cont <- false
+		}
+	}()
+	for {
+		resp, err := readResponse(c.buf.Reader, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusContinue {
+			return resp, nil
+		}
+		if !answered {
+			answered = true
+			cont <- true
+		}
+	}
+}
+
+// writeRequest writes req to the connection. If there is more of the
+// body to send after a preview, it waits for a value from cont, and
+// sends the rest if it is true (the server answered "100 Continue").
+func (c *Client) writeRequest(req *Request, cont <-chan bool) error {
+	bw := c.buf.Writer
+	if _, err := req.WriteTo(bw); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if req.Header.Get("Preview") == "" || req.PreviewEOF || req.BodyType() == NullBody {
+		return nil
+	}
+	if !<-cont {
+		return nil
+	}
+	if _, err := req.WriteRest(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Options sends an OPTIONS request for the service at urlStr, and
+// returns the capabilities the server reports, including any opt-body.
+func (c *Client) Options(urlStr string) (*Options, error) {
+	req, err := NewRequest("OPTIONS", urlStr, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("icap: OPTIONS %s: %s", urlStr, resp.Status)
+	}
+	o := new(Options)
+	if err := o.UnmarshalHeader(http.Header(resp.Header)); err != nil {
+		return nil, err
+	}
+	if len(body) > 0 {
+		o.Body = body
+	}
+	return o, nil
+}
+
+// readResponse reads and parses a response to req from br.
+func readResponse(br *bufio.Reader, req *Request) (*Response, error) {
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	f := strings.SplitN(line, " ", 3)
+	if len(f) < 2 || !strings.HasPrefix(f[0], "ICAP/") {
+		return nil, &badStringError{"malformed ICAP status line", line}
+	}
+	resp := &Response{Proto: f[0], Status: strings.Join(f[1:], " ")}
+	if resp.StatusCode, err = strconv.Atoi(f[1]); err != nil || len(f[1]) != 3 {
+		return nil, &badStringError{"malformed ICAP status code", f[1]}
+	}
+
+	resp.Header, err = tp.ReadMIMEHeader()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	s := resp.Header.Get("Encapsulated")
+	if s == "" {
+		return resp, nil
+	}
+	sections, err := parseEncapsulated(nil, s)
+	if err != nil {
+		return nil, err
+	}
+	rawReqHdr, rawRespHdr, bodySection, err := readSections(br, sections, s, DefaultMaxHeaderBytes)
+	if err != nil {
+		return nil, err
+	}
+	resp.bodySection = bodySection
+	var cr *chunkedReader
+	if bodySection != "null-body" {
+		cr = newChunkedReader(br)
+		resp.body = ioutil.NopCloser(cr)
+	}
+
+	if rawReqHdr != nil {
+		if resp.Request, err = http.ReadRequest(newHeaderReader(rawReqHdr)); err != nil {
+			return nil, &HTTPParseError{Kind: "request", Err: err}
+		}
+		resp.Request.Body = http.NoBody
+		resp.Request.ContentLength = 0
+		if bodySection == "req-body" {
+			resp.Request.Body = resp.body
+			cr.trailer = &resp.Request.Trailer
+		}
+	}
+	if rawRespHdr != nil {
+		request := resp.Request
+		if request == nil {
+			request = req.Request
+		}
+		if resp.Response, err = http.ReadResponse(newHeaderReader(rawRespHdr), request); err != nil {
+			return nil, &HTTPParseError{Kind: "response", Err: err}
+		}
+		if bodySection == "res-body" {
+			resp.Response.Body = resp.body
+			cr.trailer = &resp.Response.Trailer
+		} else if resp.Response.Body != http.NoBody {
+			resp.Response.Body = http.NoBody
+			resp.Response.ContentLength = 0
+		}
+	}
+	return resp, nil
+}
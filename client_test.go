@@ -0,0 +1,163 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	go Serve(l, EchoHandler())
+
+	c, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server: %v", err)
+	}
+	defer c.Close()
+	service := "icap://" + l.Addr().String() + "/echo"
+
+	o, err := c.Options(service)
+	if err != nil {
+		t.Fatalf("OPTIONS: %v", err)
+	}
+	if !reflect.DeepEqual(o.Methods, []string{"REQMOD", "RESPMOD"}) {
+		t.Errorf("Methods is %q (should be REQMOD, RESPMOD)", o.Methods)
+	}
+
+	// RESPMOD, on the same connection.
+	httpReq, _ := http.NewRequest("GET", "http://www.origin-server.com/origin-resource", nil)
+	httpResp := &http.Response{
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       ioutil.NopCloser(strings.NewReader("This is the content.")),
+	}
+	req, err := NewRequest("RESPMOD", service, httpReq, httpResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("RESPMOD: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Response == nil {
+		t.Fatalf("RESPMOD response is %s, with HTTP response %v (should be 200 with a response)", resp.Status, resp.Response)
+	}
+	checkString("Content-Type", resp.Response.Header.Get("Content-Type"), "text/plain", t)
+	body, err := ioutil.ReadAll(resp.Response.Body)
+	if err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	checkString("Body", string(body), "This is the content.", t)
+
+	// REQMOD with no body.
+	req, err = NewRequest("REQMOD", service, httpReq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatalf("REQMOD: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Request == nil {
+		t.Fatalf("REQMOD response is %s, with HTTP request %v (should be 200 with a request)", resp.Status, resp.Request)
+	}
+	checkString("Request URL", resp.Request.URL.Path, "/origin-resource", t)
+}
+
+// A countingReader counts the bytes read from it.
+type countingReader struct {
+	r  io.Reader
+	mu sync.Mutex
+	n  int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.mu.Lock()
+	cr.n += n
+	cr.mu.Unlock()
+	return n, err
+}
+
+func (cr *countingReader) count() int {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.n
+}
+
+func TestClientPreview(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	mux := NewServeMux()
+	mux.Handle("/echo", EchoHandler())
+	mux.HandleFunc("/skip", func(w ResponseWriter, req *Request) {
+		w.WriteHeader(http.StatusNoContent, nil, false)
+	})
+	go Serve(l, mux)
+
+	c, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server: %v", err)
+	}
+	defer c.Close()
+
+	content := strings.Repeat("This is the content. ", 1<<16)
+	for _, tc := range []struct {
+		service string
+		status  int
+		read    int // how much of the body is read, at most
+	}{
+		{"/skip", http.StatusNoContent, 11},
+		{"/echo", http.StatusOK, len(content)},
+		{"/skip", http.StatusNoContent, 11},
+	} {
+		body := &countingReader{r: strings.NewReader(content)}
+		httpReq, _ := http.NewRequest("GET", "http://www.origin-server.com/origin-resource", nil)
+		httpResp := &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       ioutil.NopCloser(body),
+		}
+		req, err := NewRequest("RESPMOD", "icap://"+l.Addr().String()+tc.service, httpReq, httpResp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Preview", "10")
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.service, err)
+		}
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: response is %s (should be %d)", tc.service, resp.Status, tc.status)
+		}
+		got, err := ioutil.ReadAll(resp.Body())
+		if err != nil {
+			t.Fatalf("%s: error reading body: %v", tc.service, err)
+		}
+		if tc.status == http.StatusOK && string(got) != content {
+			t.Errorf("%s: body is %d bytes (should be the %d bytes sent)", tc.service, len(got), len(content))
+		}
+		if n := body.count(); n > tc.read {
+			t.Errorf("%s: %d bytes of the body were read (should be at most %d)", tc.service, n, tc.read)
+		}
+	}
+}
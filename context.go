@@ -0,0 +1,198 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Request contexts, and cancelling them when the client goes away.
+
+package icap
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Context returns the request's context. For a request received by a
+// Server, it is canceled when the client closes the connection, or when
+// the request has been answered. If there is no context, it returns
+// context.Background().
+func (req *Request) Context() context.Context {
+	if req.ctx != nil {
+		return req.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of req with its context changed
+// to ctx, which must not be nil. The copy shares req's body, and files
+// created by SpillBody on either are removed with the original request.
+func (req *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("icap: nil context")
+	}
+	if req.tempFiles == nil {
+		req.tempFiles = new([]*os.File)
+	}
+	r2 := new(Request)
+	*r2 = *req
+	r2.ctx = ctx
+	return r2
+}
+
+// A connReader is the reader under a conn's bufio.Reader. When the
+// current request needs nothing more from the client, it reads in the
+// background, so that it notices if the client closes the connection.
+// Any error reading from the connection cancels the request's context.
+// It also limits how much is read for the ICAP header of a request.
+type connReader struct {
+	rwc net.Conn
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	cancel  context.CancelFunc // cancels the current request's context
+	inRead  bool               // a background read is in progress
+	hasByte bool               // byteBuf holds a byte from the background read
+	byteBuf [1]byte
+
+	// If limited, Read returns at most remain more bytes from rwc,
+	// and then io.EOF. They are only used by the conn's goroutine.
+	limited bool
+	remain  int64
+
+	total int64 // the number of bytes returned by Read; only used by the conn's goroutine
+}
+
+func newConnReader(rwc net.Conn) *connReader {
+	cr := &connReader{rwc: rwc}
+	cr.cond = sync.NewCond(&cr.mu)
+	return cr
+}
+
+func (cr *connReader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	cr.mu.Lock()
+	for cr.inRead {
+		cr.cond.Wait()
+	}
+	if cr.hasByte {
+		p[0] = cr.byteBuf[0]
+		cr.hasByte = false
+		cr.mu.Unlock()
+		cr.total++
+		return 1, nil
+	}
+	cr.mu.Unlock()
+
+	if cr.limited {
+		if cr.remain <= 0 {
+			return 0, io.EOF
+		}
+		if int64(len(p)) > cr.remain {
+			p = p[:cr.remain]
+		}
+	}
+	n, err = cr.rwc.Read(p)
+	cr.remain -= int64(n)
+	cr.total += int64(n)
+	if err != nil {
+		cr.handleReadError()
+	}
+	return n, err
+}
+
+// setReadLimit limits Read to n more bytes, or removes the limit if n
+// is negative.
+func (cr *connReader) setReadLimit(n int64) {
+	cr.limited = n >= 0
+	cr.remain = n
+}
+
+// hitReadLimit reports whether Read has returned all the bytes allowed
+// by setReadLimit.
+func (cr *connReader) hitReadLimit() bool {
+	return cr.limited && cr.remain <= 0
+}
+
+// setCancel sets the function to cancel the current request's context.
+func (cr *connReader) setCancel(cancel context.CancelFunc) {
+	cr.mu.Lock()
+	cr.cancel = cancel
+	cr.mu.Unlock()
+}
+
+func (cr *connReader) handleReadError() {
+	cr.mu.Lock()
+	cancel := cr.cancel
+	cr.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// startBackgroundRead starts watching the connection for the client
+// closing it, if it isn't being watched already.
+func (cr *connReader) startBackgroundRead() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.inRead || cr.hasByte {
+		return
+	}
+	cr.inRead = true
+	go cr.backgroundRead()
+}
+
+func (cr *connReader) backgroundRead() {
+	n, err := cr.rwc.Read(cr.byteBuf[:])
+	cr.mu.Lock()
+	if n == 1 {
+		// The start of the next request; keep it for Read.
+		cr.hasByte = true
+	}
+	cancel := cr.cancel
+	cr.inRead = false
+	cr.mu.Unlock()
+	cr.cond.Broadcast()
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		// abortPendingRead cut it off.
+		return
+	}
+	if err != nil && cancel != nil {
+		cancel()
+	}
+}
+
+// abortPendingRead stops any background read, and waits for it to
+// finish. readDeadline is the read deadline to restore afterwards.
+func (cr *connReader) abortPendingRead(readDeadline time.Time) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if !cr.inRead {
+		return
+	}
+	cr.rwc.SetReadDeadline(time.Unix(1, 0))
+	for cr.inRead {
+		cr.cond.Wait()
+	}
+	cr.rwc.SetReadDeadline(readDeadline)
+}
+
+// An eofSignal calls fn the first time a Read returns io.EOF.
+type eofSignal struct {
+	io.ReadCloser
+	fn func()
+}
+
+func (es *eofSignal) Read(p []byte) (n int, err error) {
+	n, err = es.ReadCloser.Read(p)
+	if err == io.EOF && es.fn != nil {
+		es.fn()
+		es.fn = nil
+	}
+	return n, err
+}
@@ -0,0 +1,111 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestContextDisconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	reading := make(chan bool, 1)
+	canceled := make(chan error, 1)
+	go Serve(l, HandlerFunc(func(w ResponseWriter, req *Request) {
+		ioutil.ReadAll(req.Body())
+		reading <- true
+		select {
+		case <-req.Context().Done():
+			canceled <- req.Context().Err()
+		case <-time.After(5 * time.Second):
+			canceled <- nil
+		}
+	}))
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	io.WriteString(conn, "REQMOD icap://icap-server.net/server ICAP/1.0\r\n"+
+		"Host: icap-server.net\r\n"+
+		"Encapsulated: req-hdr=0, req-body=63\r\n"+
+		"\r\n"+
+		"POST /origin-resource HTTP/1.1\r\n"+
+		"Host: www.origin-server.com\r\n"+
+		"\r\n"+
+		"5\r\n"+
+		"hello\r\n"+
+		"0\r\n"+
+		"\r\n")
+	<-reading
+	conn.Close()
+
+	if err := <-canceled; err != context.Canceled {
+		t.Errorf("context error after the client disconnected is %v (should be %v)", err, context.Canceled)
+	}
+}
+
+func TestRequestContextPipelined(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	go Serve(l, HandlerFunc(func(w ResponseWriter, req *Request) {
+		// Give the server time to read the start of the next request.
+		time.Sleep(20 * time.Millisecond)
+		if err := req.Context().Err(); err != nil {
+			t.Errorf("request %d: context error is %v while the client is waiting", req.ConnRequestNum, err)
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	io.WriteString(conn, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n"+
+		"OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n")
+	for i := 0; i < 2; i++ {
+		response, err := readResponseHeader(br)
+		if err != nil {
+			t.Fatalf("error while reading response %d: %v", i+1, err)
+		}
+		if !strings.HasPrefix(response, "ICAP/1.0 204 No Modifications\r\n") {
+			t.Fatalf("Response %d is %s (should be a 204)", i+1, response)
+		}
+	}
+}
+
+func TestRequestWithContext(t *testing.T) {
+	req := new(Request)
+	if req.Context() != context.Background() {
+		t.Errorf("default context is %v (should be context.Background())", req.Context())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r2 := req.WithContext(ctx)
+	if r2.Context() != ctx {
+		t.Errorf("WithContext did not change the context of the copy")
+	}
+	if req.Context() != context.Background() {
+		t.Errorf("WithContext changed the context of the original request")
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Copying message bodies.
+
+package icap
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// copyBufPool holds the buffers used by CopyBody.
+var copyBufPool = sync.Pool{
+	New: func() interface{} { return make([]byte, 32*1024) },
+}
+
+// CopyBody copies from src to dst until either EOF is reached on src, an
+// error occurs, or ctx is cancelled. It returns the number of bytes
+// copied and the first error encountered; reaching EOF is not an error.
+//
+// If progress is not nil, it is called with the total number of bytes
+// copied so far each time at least interval more bytes have been copied,
+// and once more at the end.
+func CopyBody(ctx context.Context, dst io.Writer, src io.Reader, interval int64, progress func(written int64)) (written int64, err error) {
+	buf := copyBufPool.Get().([]byte)
+	defer copyBufPool.Put(buf)
+
+	var reported int64
+	for {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[:nr])
+			written += int64(nw)
+			if ew == nil && nw != nr {
+				ew = io.ErrShortWrite
+			}
+			if ew != nil {
+				err = ew
+				break
+			}
+			if progress != nil && written-reported >= interval {
+				progress(written)
+				reported = written
+			}
+		}
+		if er != nil {
+			if er != io.EOF {
+				err = er
+			}
+			break
+		}
+	}
+
+	if progress != nil && written != reported {
+		progress(written)
+	}
+	return written, err
+}
@@ -0,0 +1,42 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCopyBody(t *testing.T) {
+	src := iotest.OneByteReader(strings.NewReader("hello, world"))
+	dst := new(bytes.Buffer)
+	var reports []int64
+
+	n, err := CopyBody(context.Background(), dst, src, 5, func(written int64) {
+		reports = append(reports, written)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 12 {
+		t.Errorf("copied %d bytes (should be 12)", n)
+	}
+	checkString("Copy", dst.String(), "hello, world", t)
+	if len(reports) != 3 || reports[0] != 5 || reports[1] != 10 || reports[2] != 12 {
+		t.Errorf("progress reports are %v (should be [5 10 12])", reports)
+	}
+}
+
+func TestCopyBodyCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n, err := CopyBody(ctx, new(bytes.Buffer), strings.NewReader("hello"), 0, nil)
+	if err != context.Canceled || n != 0 {
+		t.Errorf("CopyBody returned %d, %v (should be 0, context.Canceled)", n, err)
+	}
+}
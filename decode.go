@@ -0,0 +1,82 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Decoding the content encoding of encapsulated bodies.
+
+package icap
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DecodedBody returns the encapsulated body with the HTTP Content-Encoding
+// of its message removed, so that a scanner sees the content itself.
+// gzip (or x-gzip) and deflate encodings are supported, including several
+// applied in turn; a body with no Content-Encoding, or identity, is
+// returned as it is.
+//
+// Only the HTTP-level content encoding is decoded. The chunked framing
+// of the ICAP body, and any Transfer-Encoding of the HTTP message, have
+// already been removed by the time the body can be read; ICAP itself does
+// not define any compression of bodies.
+func (req *Request) DecodedBody() (io.ReadCloser, error) {
+	var h http.Header
+	switch req.BodyType() {
+	case ReqBody:
+		if req.Request != nil {
+			h = req.Request.Header
+		}
+	case ResBody:
+		if req.Response != nil {
+			h = req.Response.Header
+		}
+	}
+	body := req.Body()
+
+	// Codings are listed in the order they were applied.
+	var codings []string
+	for _, v := range h["Content-Encoding"] {
+		for _, c := range strings.Split(v, ",") {
+			if c = strings.ToLower(strings.TrimSpace(c)); c != "" && c != "identity" {
+				codings = append(codings, c)
+			}
+		}
+	}
+
+	var r io.Reader = body
+	for i := len(codings) - 1; i >= 0; i-- {
+		var err error
+		switch codings[i] {
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(r)
+		case "deflate":
+			r, err = zlib.NewReader(r)
+		default:
+			err = fmt.Errorf("icap: unsupported Content-Encoding %q", codings[i])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r == io.Reader(body) {
+		return body, nil
+	}
+	return decodedBody{r, body}, nil
+}
+
+// A decodedBody reads the decoded form of a body, and closes the
+// original body when it is closed.
+type decodedBody struct {
+	io.Reader
+	body io.Closer
+}
+
+func (b decodedBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,74 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDecodedBody(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("This is the content of the response."))
+	zw.Close()
+
+	resHdr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Encoding: gzip\r\n" +
+		"\r\n"
+	request :=
+		"RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			fmt.Sprintf("Encapsulated: res-hdr=0, res-body=%d\r\n", len(resHdr)) +
+			"\r\n" +
+			resHdr +
+			fmt.Sprintf("%x\r\n", gz.Len()) +
+			gz.String() + "\r\n" +
+			"0\r\n" +
+			"\r\n"
+
+	response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+		body, err := req.DecodedBody()
+		if err != nil {
+			t.Fatalf("DecodedBody: %v", err)
+		}
+		defer body.Close()
+		content, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatalf("error reading decoded body: %v", err)
+		}
+		checkString("Decoded body", string(content), "This is the content of the response.", t)
+		w.WriteHeader(204, nil, false)
+	}), t)
+	if !strings.HasPrefix(response, "ICAP/1.0 204 No Modifications\r\n") {
+		t.Fatalf("Response is %s (should be a 204)", response)
+	}
+}
+
+func TestDecodedBodyUnsupported(t *testing.T) {
+	resHdr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Encoding: br\r\n" +
+		"\r\n"
+	request :=
+		"RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			fmt.Sprintf("Encapsulated: res-hdr=0, res-body=%d\r\n", len(resHdr)) +
+			"\r\n" +
+			resHdr +
+			"0\r\n" +
+			"\r\n"
+	req, err := ReadRequest(newTestReadWriter(request))
+	if err != nil {
+		t.Fatalf("error while reading request: %v", err)
+	}
+	if _, err := req.DecodedBody(); err == nil {
+		t.Error("no error for unsupported Content-Encoding")
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A handler that returns each message unchanged.
+
+package icap
+
+import (
+	"net/http"
+)
+
+// echoISTag is the ISTag sent by EchoHandler. Its output never changes,
+// so neither does the tag.
+const echoISTag = "\"go-icap-echo\""
+
+// EchoHandler returns a request handler that sends every message back
+// unchanged: the HTTP request for REQMOD, and the HTTP response for
+// RESPMOD, with the body streamed through. It answers OPTIONS by
+// advertising both methods. It is useful for testing clients and
+// measuring latency, and as an example of correct pass-through.
+func EchoHandler() Handler { return HandlerFunc(echo) }
+
+func echo(w ResponseWriter, req *Request) {
+	w.Header().Set("ISTag", echoISTag)
+
+	var msg interface{}
+	switch req.Method {
+	case "OPTIONS":
+		o := &Options{
+			Methods: []string{"REQMOD", "RESPMOD"},
+			Service: "go-icap echo",
+			ISTag:   echoISTag,
+		}
+		o.Write(w)
+		return
+	case "REQMOD":
+		if req.Request != nil {
+			msg = req.Request
+		}
+	case "RESPMOD":
+		if req.Response != nil {
+			msg = req.Response
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed, nil, false)
+		return
+	}
+
+	if msg == nil {
+		w.WriteHeader(http.StatusBadRequest, nil, false)
+		return
+	}
+	WriteWithOriginalBody(w, req, msg)
+}
@@ -0,0 +1,49 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEchoHandler(t *testing.T) {
+	request :=
+		"RESPMOD icap://icap-server.net/echo ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: req-hdr=0, res-hdr=62, res-body=107\r\n" +
+			"\r\n" +
+			"GET /origin-resource HTTP/1.1\r\n" +
+			"Host: www.origin-server.com\r\n" +
+			"\r\n" +
+			"HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"\r\n"
+	body :=
+		"Encapsulated: res-hdr=0, res-body=45\r\n" +
+			"Istag: \"go-icap-echo\"\r\n" +
+			"\r\n" +
+			"HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"\r\n"
+
+	response := roundTrip(request, EchoHandler(), t)
+	if !strings.HasPrefix(response, "ICAP/1.0 200 OK\r\n") || !strings.HasSuffix(response, body) {
+		t.Fatalf("Response is %s (should echo the HTTP response)", response)
+	}
+
+	response = roundTrip("OPTIONS icap://icap-server.net/echo ICAP/1.0\r\n\r\n", EchoHandler(), t)
+	if !strings.Contains(response, "Methods: REQMOD, RESPMOD\r\n") {
+		t.Fatalf("Response is %s (should advertise both methods)", response)
+	}
+}
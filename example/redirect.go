@@ -30,13 +30,18 @@ func main() {
 	http.Handle("/", http.FileServer(http.Dir(os.Getenv("HOME")+"/Sites")))
 
 	icap.HandleFunc("/golang", toGolang)
-	icap.ListenAndServe(":11344", icap.HandlerFunc(toGolang))
+	srv := &icap.Server{
+		Addr:                   ":11344",
+		Handler:                icap.HandlerFunc(toGolang),
+		DefaultResponseHeaders: http.Header{},
+	}
+	srv.DefaultResponseHeaders.Set("ISTag", ISTag)
+	srv.DefaultResponseHeaders.Set("Service", "Golang redirector")
+	srv.ListenAndServe()
 }
 
 func toGolang(w icap.ResponseWriter, req *icap.Request) {
 	h := w.Header()
-	h.Set("ISTag", ISTag)
-	h.Set("Service", "Golang redirector")
 
 	switch req.Method {
 	case "OPTIONS":
@@ -44,7 +49,7 @@ func toGolang(w icap.ResponseWriter, req *icap.Request) {
 		h.Set("Allow", "204")
 		h.Set("Preview", "0")
 		h.Set("Transfer-Preview", "*")
-		w.WriteHeader(200, nil, false)
+		w.WriteHeader(icap.StatusOK, nil, false)
 	case "REQMOD":
 		switch req.Request.Host {
 		case "gateway":
@@ -52,16 +57,13 @@ func toGolang(w icap.ResponseWriter, req *icap.Request) {
 			icap.ServeLocally(w, req)
 		case "java.com", "www.java.com":
 			// Redirect the user to a more interesting language.
-			req.Request.Host = "golang.org"
-			req.Request.URL.Host = "golang.org"
-			w.WriteHeader(200, req.Request, false)
-			// TODO: copy the body (if any) from the original request.
+			icap.WriteRedirect(w, req, http.StatusFound, "http://golang.org/")
 		default:
 			// Return the request unmodified.
-			w.WriteHeader(204, nil, false)
+			icap.Forward(w, req)
 		}
 	default:
-		w.WriteHeader(405, nil, false)
+		w.WriteHeader(icap.StatusMethodNotAllowed, nil, false)
 		fmt.Println("Invalid request method")
 	}
 }
@@ -0,0 +1,218 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Running handlers without a network connection, and checking that
+// the responses they produce are correctly framed.
+
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// RecordResponse calls h to answer req, and returns the bytes of the
+// ICAP response it produces, without using a network connection.
+// Reading the rest of a previewed body still writes "100 Continue" to
+// the connection req was read from.
+func RecordResponse(h Handler, req *Request) []byte {
+	out := new(bytes.Buffer)
+	c := new(conn)
+	c.buf = bufio.NewReadWriter(bufio.NewReader(http.NoBody), bufio.NewWriter(out))
+
+	w := new(respWriter)
+	w.conn = c
+	w.req = req
+	w.header = make(http.Header)
+	h.ServeICAP(w, req)
+	w.finishRequest()
+
+	return out.Bytes()
+}
+
+// ValidateResponse reads one ICAP response from r and checks that it is
+// correctly framed: a valid status line, CRLF line endings throughout,
+// an Encapsulated header whose offsets match the encapsulated HTTP
+// headers, well-formed chunked encoding of the body, and nothing after
+// the end of the response. The error describes the first problem found.
+func ValidateResponse(r io.Reader) error {
+	return validateResponse(r, "")
+}
+
+// validateResponse is like ValidateResponse, but if method is not empty,
+// it also checks for the headers required in a response to a request
+// with that method: ISTag, and Methods for OPTIONS.
+func validateResponse(r io.Reader, method string) error {
+	br := bufio.NewReader(r)
+
+	line, err := readCRLFLine(br)
+	if err != nil {
+		return fmt.Errorf("icap: status line: %v", err)
+	}
+	f := strings.SplitN(line, " ", 3)
+	if len(f) < 2 || !strings.HasPrefix(f[0], "ICAP/") {
+		return &badStringError{"icap: malformed status line", line}
+	}
+	code, err := strconv.Atoi(f[1])
+	if err != nil || len(f[1]) != 3 || code < 100 {
+		return &badStringError{"icap: malformed status code", f[1]}
+	}
+
+	header := make(textproto.MIMEHeader)
+	for {
+		line, err := readCRLFLine(br)
+		if err != nil {
+			return fmt.Errorf("icap: header: %v", err)
+		}
+		if line == "" {
+			break
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 || line[0] == ' ' || line[0] == '\t' {
+			return &badStringError{"icap: malformed header line", line}
+		}
+		header.Add(textproto.CanonicalMIMEHeaderKey(line[:colon]), strings.TrimSpace(line[colon+1:]))
+	}
+
+	if method != "" && code != http.StatusContinue {
+		if header.Get("ISTag") == "" {
+			return errors.New("icap: missing ISTag header")
+		}
+		if method == "OPTIONS" && code == http.StatusOK && header.Get("Methods") == "" {
+			return errors.New("icap: missing Methods header in OPTIONS response")
+		}
+	}
+
+	encap := header.Get("Encapsulated")
+	if encap == "" {
+		if code != http.StatusNoContent && code != http.StatusContinue {
+			return errors.New("icap: missing Encapsulated header")
+		}
+		return checkEOF(br)
+	}
+	sections, err := parseEncapsulated(nil, encap)
+	if err != nil {
+		return err
+	}
+	if sections[0].offset != 0 {
+		return &badStringError{"icap: first Encapsulated section does not start at 0", encap}
+	}
+
+	var request *http.Request
+	for i, sec := range sections {
+		if i == len(sections)-1 {
+			break
+		}
+		raw := make([]byte, sections[i+1].offset-sec.offset)
+		if _, err := io.ReadFull(br, raw); err != nil {
+			return fmt.Errorf("icap: %s section: %v", sec.key, err)
+		}
+		if !bytes.HasSuffix(raw, []byte("\r\n\r\n")) {
+			return fmt.Errorf("icap: %s section does not end with a blank line; Encapsulated offsets may be wrong", sec.key)
+		}
+		if i := bareLF(raw); i != -1 {
+			return fmt.Errorf("icap: bare LF at offset %d of %s section", i, sec.key)
+		}
+		switch sec.key {
+		case "req-hdr":
+			if request, err = http.ReadRequest(newHeaderReader(raw)); err != nil {
+				return &HTTPParseError{Kind: "request", Err: err}
+			}
+		case "res-hdr":
+			if _, err = http.ReadResponse(newHeaderReader(raw), request); err != nil {
+				return &HTTPParseError{Kind: "response", Err: err}
+			}
+		}
+	}
+
+	if last := sections[len(sections)-1]; last.key != "null-body" {
+		if err := checkChunked(br); err != nil {
+			return fmt.Errorf("icap: %s: %v", last.key, err)
+		}
+	}
+	return checkEOF(br)
+}
+
+// readCRLFLine reads a line that must end with CRLF, and returns it
+// without the line ending.
+func readCRLFLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", &badStringError{"line ends with bare LF", line}
+	}
+	return line[:len(line)-2], nil
+}
+
+// checkChunked reads a chunked body from br, checking its framing.
+func checkChunked(br *bufio.Reader) error {
+	for {
+		line, err := readCRLFLine(br)
+		if err != nil {
+			return err
+		}
+		size, _ := splitChunkExtension([]byte(line))
+		if len(size) == 0 {
+			return &badStringError{"missing chunk size", line}
+		}
+		n, err := parseHexUint(size)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if _, err := io.CopyN(ioutil.Discard, br, int64(n)); err != nil {
+			return err
+		}
+		if line, err = readCRLFLine(br); err != nil {
+			return err
+		}
+		if line != "" {
+			return &badStringError{"chunk data longer than chunk size", line}
+		}
+	}
+
+	// The trailer, ending with a blank line.
+	for {
+		line, err := readCRLFLine(br)
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+	}
+}
+
+// checkEOF returns an error if br has any more data.
+func checkEOF(br *bufio.Reader) error {
+	if _, err := br.Peek(1); err != io.EOF {
+		return errors.New("icap: data after end of response")
+	}
+	return nil
+}
+
+// bareLF returns the index of the first LF in b that is not preceded by CR, or -1.
+func bareLF(b []byte) int {
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			return i
+		}
+	}
+	return -1
+}
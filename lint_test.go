@@ -0,0 +1,62 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndValidate(t *testing.T) {
+	for _, request := range []string{
+		reqmodNoBody,
+		previewRequest("5\r\nhello\r\n0; ieof\r\n\r\n"),
+		"OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n",
+	} {
+		req, err := ReadRequest(newTestReadWriter(request))
+		if err != nil {
+			t.Fatalf("error reading request: %v", err)
+		}
+		resp := RecordResponse(EchoHandler(), req)
+		if err := ValidateResponse(bytes.NewReader(resp)); err != nil {
+			t.Errorf("error validating %q: %v", resp, err)
+		}
+	}
+}
+
+func TestValidateResponseErrors(t *testing.T) {
+	good := "ICAP/1.0 200 OK\r\n" +
+		"Encapsulated: res-hdr=0, res-body=45\r\n" +
+		"\r\n" +
+		"HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"5\r\n" +
+		"hello\r\n" +
+		"0\r\n" +
+		"\r\n"
+	if err := ValidateResponse(strings.NewReader(good)); err != nil {
+		t.Fatalf("error validating good response: %v", err)
+	}
+
+	for _, c := range []struct {
+		description string
+		old, new    string
+	}{
+		{"wrong offset", "res-body=45", "res-body=44"},
+		{"bare LF", "Content-Type: text/plain\r\n", "Content-Type: text/plain\n\r"},
+		{"bad status", "ICAP/1.0 200", "ICAP/1.0 2000"},
+		{"short chunk", "5\r\nhello", "4\r\nhello"},
+		{"missing terminator", "0\r\n\r\n", "0\r\n"},
+		{"trailing data", "0\r\n\r\n", "0\r\n\r\nextra"},
+		{"missing Encapsulated", "Encapsulated:", "X-Encapsulated:"},
+	} {
+		bad := strings.Replace(good, c.old, c.new, 1)
+		if err := ValidateResponse(strings.NewReader(bad)); err == nil {
+			t.Errorf("no error for response with %s", c.description)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Wrapping handlers in middleware.
+
+package icap
+
+// Chain returns h wrapped in the middleware mw, for cross-cutting
+// concerns such as authentication, metrics or rate limiting. The first
+// middleware is the outermost: a request passes through mw[0], then
+// mw[1], and so on, before it reaches h.
+//
+// A middleware can answer a request itself instead of calling the
+// handler it wraps, and can observe the response by checking whether
+// the ResponseWriter is a StatusReporter after that handler returns.
+// It can also pass the handler its own ResponseWriter, usually a struct
+// that embeds the original one. Functions such as Finish and
+// WriteRedirect write through the wrapper's methods, so it sees the
+// whole response; it should have an Unwrap method (see ResponseWriter).
+//
+// If h is a ServeMux, or another Handler with Options for its services,
+// the Handler returned keeps its OptionsFor method, so that
+// Server.AutoOptions still answers OPTIONS requests from them. Those
+// requests do not pass through mw.
+func Chain(h Handler, mw ...func(Handler) Handler) Handler {
+	p, hasOptions := h.(optionsProvider)
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	if _, ok := h.(optionsProvider); hasOptions && !ok {
+		return chained{h, p}
+	}
+	return h
+}
+
+// A chained is a Handler wrapped in middleware by Chain, with the
+// OptionsFor method of the Handler inside.
+type chained struct {
+	Handler
+	options optionsProvider
+}
+
+func (c chained) OptionsFor(r *Request) *Options {
+	return c.options.OptionsFor(r)
+}
+
+// A StatusReporter reports the status code of the response it is
+// writing, or 0 if none has been written yet. The ResponseWriter that
+// the server passes to handlers is one; a wrapper around it that wants
+// to stay one must define a Status method of its own, which may call
+// the wrapped writer's.
+type StatusReporter interface {
+	Status() int
+}
+
+// A ByteCounter reports how many bytes of encapsulated body have been
+// written to it, before chunked encoding. Like StatusReporter, it is
+// implemented by the ResponseWriter that the server passes to handlers,
+// but not by wrappers that do not define it themselves.
+type ByteCounter interface {
+	BytesWritten() int64
+}
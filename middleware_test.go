@@ -0,0 +1,260 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A bodyCounter is a ResponseWriter that counts the body bytes written.
+type bodyCounter struct {
+	ResponseWriter
+	n *int
+}
+
+func (w bodyCounter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	*w.n += n
+	return n, err
+}
+
+func (w bodyCounter) Unwrap() ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w bodyCounter) Status() int {
+	return w.ResponseWriter.(StatusReporter).Status()
+}
+
+func TestChain(t *testing.T) {
+	request := "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Allow: 204\r\n" +
+		"Encapsulated: req-hdr=0, null-body=62\r\n" +
+		"\r\n" +
+		"GET /origin-resource HTTP/1.1\r\n" +
+		"Host: www.origin-server.com\r\n" +
+		"\r\n"
+
+	var order []string
+	var statuses []int
+	var written int
+	tag := func(name string) func(Handler) Handler {
+		return func(h Handler) Handler {
+			return HandlerFunc(func(w ResponseWriter, req *Request) {
+				order = append(order, name)
+				h.ServeICAP(w, req)
+				statuses = append(statuses, w.(StatusReporter).Status())
+			})
+		}
+	}
+	replaceWriter := func(h Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, req *Request) {
+			h.ServeICAP(bodyCounter{w, &written}, req)
+		})
+	}
+
+	for _, c := range []struct {
+		handler HandlerFunc
+		status  int
+		written int
+	}{
+		{func(w ResponseWriter, req *Request) { Finish(w, req, false, nil) }, 204, 0},
+		{func(w ResponseWriter, req *Request) { WriteRedirect(w, req, 302, "/elsewhere") }, 200, 60},
+		{func(w ResponseWriter, req *Request) {
+			w.WriteHeader(200, req.Request, true)
+			io.WriteString(w, "hello")
+		}, 200, 5},
+		{func(w ResponseWriter, req *Request) {}, 0, 0},
+	} {
+		order, statuses, written = nil, nil, 0
+		h := Chain(c.handler, tag("outer"), replaceWriter, tag("inner"))
+		response := serverRoundTrip(&Server{Handler: h}, request, t)
+
+		checkString("Order", fmt.Sprint(order), "[outer inner]", t)
+		if fmt.Sprint(statuses) != fmt.Sprint([]int{c.status, c.status}) {
+			t.Errorf("statuses seen by middleware are %v (should be %d)", statuses, c.status)
+		}
+		if written != c.written {
+			t.Errorf("middleware's ResponseWriter counted %d bytes (should be %d)", written, c.written)
+		}
+		if c.written == 5 && !strings.Contains(response, "\r\nhello\r\n") {
+			t.Errorf("body missing from %q", response)
+		}
+	}
+
+	if h := Chain(NotFoundHandler()); h == nil {
+		t.Error("Chain with no middleware returned nil")
+	}
+}
+
+// A statusRecorder is a ResponseWriter that records the status codes
+// passed to WriteHeader.
+type statusRecorder struct {
+	ResponseWriter
+	codes *[]int
+}
+
+func (w statusRecorder) WriteHeader(code int, httpMessage interface{}, hasBody bool) {
+	*w.codes = append(*w.codes, code)
+	w.ResponseWriter.WriteHeader(code, httpMessage, hasBody)
+}
+
+func (w statusRecorder) Unwrap() ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestChainReplacesWriter(t *testing.T) {
+	request := "RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: res-hdr=0, res-body=45\r\n" +
+		"\r\n" +
+		"HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"5\r\nhello\r\n0\r\n\r\n"
+
+	// Every way of answering goes through the middleware's WriteHeader.
+	for _, c := range []struct {
+		handler HandlerFunc
+		status  int
+	}{
+		{func(w ResponseWriter, req *Request) { Finish(w, req, false, nil) }, 200},
+		{func(w ResponseWriter, req *Request) { Finish(w, req, true, http.Header{"X-A": {"1"}}) }, 200},
+		{func(w ResponseWriter, req *Request) { WriteRedirect(w, req, 302, "/elsewhere") }, 200},
+		{func(w ResponseWriter, req *Request) { Forward(w, req) }, 200},
+		{func(w ResponseWriter, req *Request) { WritePartial(w, req, 1, []byte("E"), true) }, 200},
+		{func(w ResponseWriter, req *Request) {
+			SatisfyWithResponse(w, BlockResponse(403, nil, "text/plain"), false)
+		}, 200},
+		{func(w ResponseWriter, req *Request) { NotFound(w, req) }, 404},
+	} {
+		var codes []int
+		h := Chain(c.handler, func(h Handler) Handler {
+			return HandlerFunc(func(w ResponseWriter, req *Request) {
+				h.ServeICAP(statusRecorder{w, &codes}, req)
+			})
+		})
+		response := serverRoundTrip(&Server{Handler: h}, request, t)
+		if fmt.Sprint(codes) != fmt.Sprint([]int{c.status}) {
+			t.Errorf("middleware saw WriteHeader calls with %v (should be [%d]); response is %s", codes, c.status, response)
+		}
+	}
+}
+
+func TestChainAutoOptions(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("/scan", func(w ResponseWriter, req *Request) {
+		t.Error("handler called for OPTIONS request")
+	})
+	mux.SetOptions("/scan", &Options{
+		Methods: []string{"RESPMOD"},
+		ISTag:   "\"scan-1\"",
+	})
+	h := Chain(mux, func(h Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, req *Request) {
+			h.ServeICAP(w, req)
+		})
+	})
+	srv := &Server{AutoOptions: true, Handler: h}
+
+	response := serverRoundTrip(srv, "OPTIONS icap://icap-server.net/scan ICAP/1.0\r\n"+
+		"Host: icap-server.net\r\n"+
+		"\r\n", t)
+	if !strings.HasPrefix(response, "ICAP/1.0 200 OK\r\n") || !strings.Contains(response, "Methods: RESPMOD\r\n") {
+		t.Errorf("Response is %s (should be a 200 with the registered options)", response)
+	}
+}
+
+func TestStatusReporter(t *testing.T) {
+	request := "RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: res-hdr=0, res-body=45\r\n" +
+		"\r\n" +
+		"HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"5\r\nhello\r\n0\r\n\r\n"
+
+	var before, held int
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			var body io.Writer = w
+			sr, ok := body.(StatusReporter)
+			if !ok {
+				t.Error("ResponseWriter is not a StatusReporter")
+				return
+			}
+			before = sr.Status()
+			BufferBody(w)
+			w.WriteHeader(200, req.Response, true)
+			io.Copy(w, req.Response.Body)
+			held = sr.Status()
+		}),
+	}
+	response := serverRoundTrip(srv, request, t)
+	checkString("Status line", response[:len("ICAP/1.0 200")], "ICAP/1.0 200", t)
+	if before != 0 || held != 200 {
+		t.Errorf("Status is %d before WriteHeader and %d while the response is held (should be 0 and 200)", before, held)
+	}
+}
+
+func TestByteCounter(t *testing.T) {
+	request := "RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: res-hdr=0, res-body=45\r\n" +
+		"\r\n" +
+		"HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"5\r\nhello\r\n0\r\n\r\n"
+
+	for _, c := range []struct {
+		handler HandlerFunc
+		written int64
+	}{
+		{func(w ResponseWriter, req *Request) {
+			w.WriteHeader(200, req.Response, true)
+			io.WriteString(w, "hello")
+			io.WriteString(w, ", world")
+		}, 12},
+		{func(w ResponseWriter, req *Request) { Forward(w, req) }, 5},
+		{func(w ResponseWriter, req *Request) { w.WriteHeader(204, nil, false) }, 0},
+	} {
+		var mu sync.Mutex
+		var counted int64 = -1
+		var info RequestInfo
+		srv := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+				c.handler(w, req)
+				var body io.Writer = w
+				if bc, ok := body.(ByteCounter); ok {
+					mu.Lock()
+					counted = bc.BytesWritten()
+					mu.Unlock()
+				}
+			}),
+			OnRequest: func(req *Request, i *RequestInfo) {
+				mu.Lock()
+				info = *i
+				mu.Unlock()
+			},
+		}
+		serverRoundTrip(srv, request, t)
+		mu.Lock()
+		if counted != c.written || info.BodyBytesWritten != c.written {
+			t.Errorf("BytesWritten is %d, and BodyBytesWritten %d (should be %d)", counted, info.BodyBytesWritten, c.written)
+		}
+		if info.BytesWritten <= c.written {
+			t.Errorf("BytesWritten on the connection is %d (should be more than the %d body bytes)", info.BytesWritten, c.written)
+		}
+		mu.Unlock()
+	}
+}
@@ -9,20 +9,37 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"sync"
 )
 
 // ServeMux is an ICAP request multiplexer.
 // It matches the URL of each incoming request against a list of registered
 // patterns and calls the handler for the pattern that
 // most closely matches the URL.
-// 
+//
+// Patterns name fixed, rooted paths, like "/scan", or rooted subtrees,
+// like "/scan/". A pattern ending in a slash matches every path that
+// starts with it, so "/scan/" matches "/scan/fast" as well as "/scan/";
+// longer patterns take precedence over shorter ones. The query (the
+// service's arguments) is not part of the path. Patterns may start with
+// a host name, to match only URLs on that host.
+//
 // For more details, see the documentation for http.ServeMux
 type ServeMux struct {
-	m map[string]Handler
+	mu   sync.RWMutex
+	m    map[string]muxEntry
+	opts map[string]*Options
+}
+
+type muxEntry struct {
+	h        Handler
+	explicit bool // registered with Handle, not a redirect to a subtree
 }
 
 // NewServeMux allocates and returns a new ServeMux.
-func NewServeMux() *ServeMux { return &ServeMux{make(map[string]Handler)} }
+func NewServeMux() *ServeMux {
+	return &ServeMux{m: make(map[string]muxEntry), opts: make(map[string]*Options)}
+}
 
 // DefaultServeMux is the default ServeMux used by Serve.
 var DefaultServeMux = NewServeMux()
@@ -59,8 +76,7 @@ func cleanPath(p string) string {
 
 // Find a handler on a handler map given a path string
 // Most-specific (longest) pattern wins
-func (mux *ServeMux) match(path string) Handler {
-	var h Handler
+func (mux *ServeMux) match(path string) (h Handler, pattern string) {
 	var n = 0
 	for k, v := range mux.m {
 		if !pathMatch(k, path) {
@@ -68,29 +84,56 @@ func (mux *ServeMux) match(path string) Handler {
 		}
 		if h == nil || len(k) > n {
 			n = len(k)
-			h = v
+			h = v.h
+			pattern = k
 		}
 	}
-	return h
+	return
 }
 
-// ServeICAP dispatches the request to the handler whose
-// pattern most closely matches the request URL.
-func (mux *ServeMux) ServeICAP(w ResponseWriter, r *Request) {
+// Find the Options registered for the most specific pattern matching path.
+func (mux *ServeMux) matchOptions(path string) *Options {
+	var o *Options
+	var n = 0
+	for k, v := range mux.opts {
+		if !pathMatch(k, path) {
+			continue
+		}
+		if o == nil || len(k) > n {
+			n = len(k)
+			o = v
+		}
+	}
+	return o
+}
+
+// Handler returns the handler to use for r, and the pattern that
+// matches r's URL. If the URL's path is not in canonical form, the
+// handler redirects to the canonical path. If no pattern matches, the
+// handler replies with 404. In both cases the pattern is "".
+func (mux *ServeMux) Handler(r *Request) (h Handler, pattern string) {
 	// Clean path to canonical form and redirect.
 	if p := cleanPath(r.URL.Path); p != r.URL.Path {
-		w.Header().Set("Location", p)
-		w.WriteHeader(http.StatusMovedPermanently, nil, false)
-		return
+		return RedirectHandler(p, http.StatusMovedPermanently), ""
 	}
+
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
 	// Host-specific pattern takes precedence over generic ones
-	h := mux.match(r.URL.Host + r.URL.Path)
+	h, pattern = mux.match(r.URL.Host + r.URL.Path)
 	if h == nil {
-		h = mux.match(r.URL.Path)
+		h, pattern = mux.match(r.URL.Path)
 	}
 	if h == nil {
-		h = NotFoundHandler()
+		h, pattern = NotFoundHandler(), ""
 	}
+	return
+}
+
+// ServeICAP dispatches the request to the handler whose
+// pattern most closely matches the request URL.
+func (mux *ServeMux) ServeICAP(w ResponseWriter, r *Request) {
+	h, _ := mux.Handler(r)
 	h.ServeICAP(w, r)
 }
 
@@ -100,16 +143,43 @@ func (mux *ServeMux) Handle(pattern string, handler Handler) {
 		panic("icap: invalid pattern " + pattern)
 	}
 
-	mux.m[pattern] = handler
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	mux.m[pattern] = muxEntry{h: handler, explicit: true}
 
 	// Helpful behavior:
-	// If pattern is /tree/, insert permanent redirect for /tree.
+	// If pattern is /tree/, insert permanent redirect for /tree,
+	// unless a handler has been registered for /tree itself.
 	n := len(pattern)
-	if n > 0 && pattern[n-1] == '/' {
-		mux.m[pattern[0:n-1]] = RedirectHandler(pattern, http.StatusMovedPermanently)
+	if n > 0 && pattern[n-1] == '/' && !mux.m[pattern[0:n-1]].explicit {
+		mux.m[pattern[0:n-1]] = muxEntry{h: RedirectHandler(pattern, http.StatusMovedPermanently)}
 	}
 }
 
+// SetOptions registers the capabilities of the service at the given
+// pattern, for answering OPTIONS requests when Server.AutoOptions is set.
+// Patterns are matched the same way as for Handle.
+func (mux *ServeMux) SetOptions(pattern string, opts *Options) {
+	if pattern == "" {
+		panic("icap: invalid pattern " + pattern)
+	}
+	mux.mu.Lock()
+	mux.opts[pattern] = opts
+	mux.mu.Unlock()
+}
+
+// OptionsFor returns the Options registered for the service that r is
+// addressed to, or nil if there are none.
+func (mux *ServeMux) OptionsFor(r *Request) *Options {
+	p := cleanPath(r.URL.Path)
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	if o := mux.matchOptions(r.URL.Host + p); o != nil {
+		return o
+	}
+	return mux.matchOptions(p)
+}
+
 // HandleFunc registers the handler function for the given pattern.
 func (mux *ServeMux) HandleFunc(pattern string, handler func(ResponseWriter, *Request)) {
 	mux.Handle(pattern, HandlerFunc(handler))
@@ -127,13 +197,17 @@ func HandleFunc(pattern string, handler func(ResponseWriter, *Request)) {
 	DefaultServeMux.HandleFunc(pattern, handler)
 }
 
+// SetOptions registers the capabilities of the service at the given
+// pattern in the DefaultServeMux.
+func SetOptions(pattern string, opts *Options) { DefaultServeMux.SetOptions(pattern, opts) }
+
 // NotFound replies to the request with an HTTP 404 not found error.
 func NotFound(w ResponseWriter, r *Request) {
 	w.WriteHeader(http.StatusNotFound, nil, false)
 }
 
 // NotFoundHandler returns a simple request handler
-// that replies to each request with a ``404 page not found'' reply.
+// that replies to each request with a “404 page not found” reply.
 func NotFoundHandler() Handler { return HandlerFunc(NotFound) }
 
 // Redirect to a fixed URL
@@ -0,0 +1,69 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestServeMuxHandler(t *testing.T) {
+	mux := NewServeMux()
+	for _, pattern := range []string{"/scan/", "/scan/fast/", "/filter", "icap.example.com/filter"} {
+		mux.HandleFunc(pattern, func(w ResponseWriter, req *Request) {})
+	}
+
+	for _, test := range []struct {
+		url, pattern string
+	}{
+		{"icap://icap-server.net/scan/", "/scan/"},
+		{"icap://icap-server.net/scan/foo?mode=deep", "/scan/"},
+		{"icap://icap-server.net/scan/fast/foo", "/scan/fast/"},
+		{"icap://icap-server.net/scan", "/scan"},
+		{"icap://icap-server.net/filter", "/filter"},
+		{"icap://icap.example.com/filter", "icap.example.com/filter"},
+		{"icap://icap-server.net/filter/foo", ""},
+		{"icap://icap-server.net/other", ""},
+		{"icap://icap-server.net/scan/../filter", ""},
+	} {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, pattern := mux.Handler(&Request{URL: u})
+		if h == nil {
+			t.Errorf("no handler for %s", test.url)
+		}
+		if pattern != test.pattern {
+			t.Errorf("pattern for %s is %q (should be %q)", test.url, pattern, test.pattern)
+		}
+	}
+}
+
+func TestServeMuxSubtreeRedirect(t *testing.T) {
+	request := "REQMOD icap://icap-server.net/scan ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: null-body=0\r\n" +
+		"\r\n"
+
+	mux := NewServeMux()
+	mux.HandleFunc("/scan/", func(w ResponseWriter, req *Request) {
+		w.WriteHeader(204, nil, false)
+	})
+	response := serverRoundTrip(&Server{Handler: mux}, request, t)
+	checkString("Status line", response[:len("ICAP/1.0 301")], "ICAP/1.0 301", t)
+
+	// A handler registered for /scan itself is not replaced by the
+	// redirect, whichever is registered first.
+	mux = NewServeMux()
+	mux.HandleFunc("/scan", func(w ResponseWriter, req *Request) {
+		w.WriteHeader(204, nil, false)
+	})
+	mux.HandleFunc("/scan/", func(w ResponseWriter, req *Request) {
+		w.WriteHeader(500, nil, false)
+	})
+	response = serverRoundTrip(&Server{Handler: mux}, request, t)
+	checkString("Status line", response[:len("ICAP/1.0 204")], "ICAP/1.0 204", t)
+}
@@ -0,0 +1,257 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The capabilities a service advertises in its OPTIONS response.
+
+package icap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Options describes the capabilities of an ICAP service, as carried in
+// the headers of an OPTIONS response (RFC 3507, section 4.10.2).
+// A server uses it to build its OPTIONS response, and a client
+// uses it to interpret one.
+type Options struct {
+	Methods        []string // REQMOD, RESPMOD; exactly one is expected per service
+	Service        string   // a text description of the service
+	ISTag          string   // the service's state tag, including quotes
+	ServiceID      string   // a short identifier for the service
+	MaxConnections int      // the maximum number of connections; 0 if unlimited
+	TTL            int      // seconds the OPTIONS response is valid; 0 if unspecified
+	Allow204       bool     // whether 204 No Modifications responses are supported
+
+	// Preview is the number of bytes to send as a preview. It is sent
+	// as the Preview header only if HasPreview is true; otherwise the
+	// header is left out, meaning that previews are not supported.
+	// (Preview: 0 asks for the HTTP headers alone, and then for the
+	// client to wait for "100 Continue" before sending the body.)
+	Preview    int
+	HasPreview bool
+
+	// The file extensions for which the whole body, none of the body,
+	// or a preview of the body should be sent. "*" matches all other
+	// extensions.
+	TransferPreview  []string
+	TransferIgnore   []string
+	TransferComplete []string
+
+	// Body is an optional opt-body sent with the OPTIONS response, such
+	// as a machine-readable description of the service. BodyType names
+	// its format, and is sent as the Opt-body-type header.
+	Body     []byte
+	BodyType string
+}
+
+// MarshalHeader sets the fields of h that describe o.
+// Fields with zero values are left out, and so is Preview unless
+// HasPreview is true.
+func (o *Options) MarshalHeader(h http.Header) {
+	setList := func(key string, values []string) {
+		if len(values) > 0 {
+			h.Set(key, strings.Join(values, ", "))
+		}
+	}
+	setString := func(key, value string) {
+		if value != "" {
+			h.Set(key, value)
+		}
+	}
+
+	setList("Methods", o.Methods)
+	setString("Service", o.Service)
+	setString("ISTag", o.ISTag)
+	setString("Service-ID", o.ServiceID)
+	if o.MaxConnections > 0 {
+		h.Set("Max-Connections", strconv.Itoa(o.MaxConnections))
+	}
+	if o.TTL > 0 {
+		h.Set("Options-TTL", strconv.Itoa(o.TTL))
+	}
+	if o.Allow204 {
+		h.Set("Allow", "204")
+	}
+	if o.HasPreview {
+		h.Set("Preview", strconv.Itoa(o.Preview))
+	}
+	setList("Transfer-Preview", o.TransferPreview)
+	setList("Transfer-Ignore", o.TransferIgnore)
+	setList("Transfer-Complete", o.TransferComplete)
+	setString("Opt-body-type", o.BodyType)
+}
+
+// UnmarshalHeader sets the fields of o from the OPTIONS response headers in h.
+// Body is left empty, since it is not part of the header.
+func (o *Options) UnmarshalHeader(h http.Header) error {
+	*o = Options{
+		Methods:          headerList(h, "Methods"),
+		Service:          h.Get("Service"),
+		ISTag:            h.Get("ISTag"),
+		ServiceID:        h.Get("Service-ID"),
+		TransferPreview:  headerList(h, "Transfer-Preview"),
+		TransferIgnore:   headerList(h, "Transfer-Ignore"),
+		TransferComplete: headerList(h, "Transfer-Complete"),
+		BodyType:         h.Get("Opt-body-type"),
+	}
+
+	var err error
+	if s := h.Get("Max-Connections"); s != "" {
+		if o.MaxConnections, err = strconv.Atoi(s); err != nil {
+			return &badStringError{"malformed Max-Connections: header", s}
+		}
+	}
+	if s := h.Get("Options-TTL"); s != "" {
+		if o.TTL, err = strconv.Atoi(s); err != nil {
+			return &badStringError{"malformed Options-TTL: header", s}
+		}
+	}
+	if s := h.Get("Preview"); s != "" {
+		if o.Preview, err = strconv.Atoi(s); err != nil || o.Preview < 0 {
+			return &badStringError{"malformed Preview: header", s}
+		}
+		o.HasPreview = true
+	}
+	for _, a := range headerList(h, "Allow") {
+		if a == "204" {
+			o.Allow204 = true
+		}
+	}
+	return nil
+}
+
+// A TransferMode says how much of a body the client should send to
+// the service, in an OPTIONS response's Transfer-* headers.
+type TransferMode int
+
+const (
+	PreviewTransfer  TransferMode = iota // send a preview (Transfer-Preview)
+	IgnoreTransfer                       // don't send the body (Transfer-Ignore)
+	CompleteTransfer                     // send the whole body (Transfer-Complete)
+)
+
+// SetTransferPolicy sets o.TransferPreview, o.TransferIgnore, and
+// o.TransferComplete from policy, which maps file extensions (such as
+// "exe" or ".zip") to how bodies of that type should be sent. The key
+// "*" gives the mode for all other extensions. Extensions are written
+// in lower case, without the dot, in sorted order, with "*" last.
+func (o *Options) SetTransferPolicy(policy map[string]TransferMode) error {
+	var lists [3][]string
+	var hasDefault [3]bool
+	for ext, mode := range policy {
+		if mode < PreviewTransfer || mode > CompleteTransfer {
+			return fmt.Errorf("icap: invalid TransferMode %d for %q", mode, ext)
+		}
+		if ext == "*" {
+			hasDefault[mode] = true
+			continue
+		}
+		e := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if e == "" || strings.ContainsAny(e, ", \t*") {
+			return &badStringError{"icap: invalid file extension in transfer policy", ext}
+		}
+		lists[mode] = append(lists[mode], e)
+	}
+	for mode := range lists {
+		sort.Strings(lists[mode])
+		if hasDefault[mode] {
+			lists[mode] = append(lists[mode], "*")
+		}
+	}
+	o.TransferPreview = lists[PreviewTransfer]
+	o.TransferIgnore = lists[IgnoreTransfer]
+	o.TransferComplete = lists[CompleteTransfer]
+	return nil
+}
+
+// SetJSONBody sets o.Body to the JSON encoding of v, and o.BodyType
+// to "application/json", to publish a capabilities document that
+// orchestration tools can read.
+func (o *Options) SetJSONBody(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	o.Body = b
+	o.BodyType = "application/json"
+	return nil
+}
+
+// Write sends o to w as a successful OPTIONS response, with o.Body
+// as the opt-body if it is not empty.
+func (o *Options) Write(w ResponseWriter) {
+	o.MarshalHeader(w.Header())
+	if len(o.Body) == 0 {
+		w.WriteHeader(http.StatusOK, nil, false)
+		return
+	}
+	w.WriteHeader(http.StatusOK, nil, true)
+	w.Write(o.Body)
+}
+
+// WriteWithBody is like Write, but the opt-body is copied from body as
+// it is sent, instead of being taken from o.Body, for a body too large
+// to hold in memory, such as a list of ISTags. o.BodyType should name
+// its format. The Encapsulated header is "opt-body=0", even if body
+// turns out to be empty.
+func (o *Options) WriteWithBody(w ResponseWriter, body io.Reader) error {
+	o.MarshalHeader(w.Header())
+	w.WriteHeader(http.StatusOK, nil, true)
+	_, err := io.Copy(w, body)
+	return err
+}
+
+// OptBody reads the opt-body of an OPTIONS request, which some clients
+// use to send vendor-specific metadata, and returns it with its format
+// from the Opt-body-type header. If the request has no opt-body, body
+// is nil.
+func (req *Request) OptBody() (body []byte, bodyType string, err error) {
+	if req.BodyType() != OptBody {
+		return nil, "", nil
+	}
+	body, err = ioutil.ReadAll(req.Body())
+	if err != nil {
+		return nil, "", err
+	}
+	return body, req.Header.Get("Opt-body-type"), nil
+}
+
+// SetOptBody sets the opt-body of an OPTIONS request to be sent with a
+// Client, and its format, which goes in the Opt-body-type header if it
+// is not empty. It is an error to call it for another method.
+func (req *Request) SetOptBody(body io.Reader, bodyType string) error {
+	if req.Method != "OPTIONS" {
+		return fmt.Errorf("icap: SetOptBody called for a %s request", req.Method)
+	}
+	rc, ok := body.(io.ReadCloser)
+	if !ok {
+		rc = ioutil.NopCloser(body)
+	}
+	req.bodySection = "opt-body"
+	req.body = rc
+	if bodyType != "" {
+		req.Header.Set("Opt-body-type", bodyType)
+	}
+	return nil
+}
+
+// headerList returns the comma-separated values of all the key fields in h.
+func headerList(h http.Header, key string) []string {
+	var list []string
+	for _, v := range h[http.CanonicalHeaderKey(key)] {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,256 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOptionsRoundTrip(t *testing.T) {
+	o := Options{
+		Methods:          []string{"RESPMOD"},
+		Service:          "Virus Scanner 1.0",
+		ISTag:            "\"W3E4R7U9-L2E4-2\"",
+		ServiceID:        "scan",
+		MaxConnections:   100,
+		TTL:              3600,
+		Allow204:         true,
+		Preview:          0,
+		HasPreview:       true,
+		TransferPreview:  []string{"*"},
+		TransferIgnore:   []string{"jpg", "gif"},
+		TransferComplete: []string{"bat", "exe"},
+	}
+
+	h := make(http.Header)
+	o.MarshalHeader(h)
+	checkString("Transfer-Ignore", h.Get("Transfer-Ignore"), "jpg, gif", t)
+	checkString("Preview", h.Get("Preview"), "0", t)
+
+	var o2 Options
+	if err := o2.UnmarshalHeader(h); err != nil {
+		t.Fatalf("error unmarshaling: %v", err)
+	}
+	if !reflect.DeepEqual(o, o2) {
+		t.Fatalf("Options are %+v (should be %+v)", o2, o)
+	}
+}
+
+func TestOptionsNoPreview(t *testing.T) {
+	h := make(http.Header)
+	(&Options{}).MarshalHeader(h)
+	if len(h) != 0 {
+		t.Fatalf("header is %v (should be empty)", h)
+	}
+
+	var o Options
+	if err := o.UnmarshalHeader(h); err != nil {
+		t.Fatalf("error unmarshaling: %v", err)
+	}
+	if o.HasPreview {
+		t.Fatalf("HasPreview is true without a Preview header")
+	}
+}
+
+func TestOptionsJSONBody(t *testing.T) {
+	o := &Options{
+		Methods:   []string{"RESPMOD"},
+		ServiceID: "scan",
+	}
+	if err := o.SetJSONBody(map[string]string{"engine": "scan-2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	response := roundTrip("OPTIONS icap://icap-server.net/scan ICAP/1.0\r\n\r\n", HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.Header().Set("Date", "Mon, 10 Jan 2000  09:55:21 GMT")
+		o.Write(w)
+	}), t)
+	resp :=
+		"ICAP/1.0 200 OK\r\n" +
+			"Connection: keep-alive\r\n" +
+			"Date: Mon, 10 Jan 2000  09:55:21 GMT\r\n" +
+			"Encapsulated: opt-body=0\r\n" +
+			"Methods: RESPMOD\r\n" +
+			"Opt-Body-Type: application/json\r\n" +
+			"Service-Id: scan\r\n" +
+			"\r\n" +
+			"13\r\n" +
+			"{\"engine\":\"scan-2\"}\r\n" +
+			"0\r\n" +
+			"\r\n"
+	checkString("Response", response, resp, t)
+}
+
+func TestOptionsWriteWithBody(t *testing.T) {
+	o := &Options{
+		Methods:  []string{"REQMOD"},
+		BodyType: "text/plain",
+	}
+	response := roundTrip("OPTIONS icap://icap-server.net/istags ICAP/1.0\r\n\r\n", HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.Header().Set("Date", "Mon, 10 Jan 2000  09:55:21 GMT")
+		if err := o.WriteWithBody(w, strings.NewReader("\"scan-1\"\n\"scan-2\"\n")); err != nil {
+			t.Error(err)
+		}
+	}), t)
+	resp :=
+		"ICAP/1.0 200 OK\r\n" +
+			"Connection: keep-alive\r\n" +
+			"Date: Mon, 10 Jan 2000  09:55:21 GMT\r\n" +
+			"Encapsulated: opt-body=0\r\n" +
+			"Methods: REQMOD\r\n" +
+			"Opt-Body-Type: text/plain\r\n" +
+			"\r\n" +
+			"12\r\n" +
+			"\"scan-1\"\n\"scan-2\"\n\r\n" +
+			"0\r\n" +
+			"\r\n"
+	checkString("Response", response, resp, t)
+}
+
+func TestRequestOptBody(t *testing.T) {
+	request :=
+		"OPTIONS icap://icap-server.net/scan ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: opt-body=0\r\n" +
+			"Opt-body-type: X-Vendor-Profile-1.0\r\n" +
+			"\r\n" +
+			"7\r\n" +
+			"profile\r\n" +
+			"0\r\n" +
+			"\r\n"
+	req, err := ReadRequest(newTestReadWriter(request))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	body, bodyType, err := req.OptBody()
+	if err != nil {
+		t.Fatalf("error reading opt-body: %v", err)
+	}
+	checkString("opt-body", string(body), "profile", t)
+	checkString("Opt-body-type", bodyType, "X-Vendor-Profile-1.0", t)
+
+	req, err = ReadRequest(newTestReadWriter("OPTIONS icap://icap-server.net/scan ICAP/1.0\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	if body, _, err := req.OptBody(); body != nil || err != nil {
+		t.Errorf("OptBody returned %q, %v (should be nil, nil)", body, err)
+	}
+}
+
+func TestClientOptBody(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	var mu sync.Mutex
+	var body []byte
+	var bodyType string
+	var readErr error
+	go Serve(l, HandlerFunc(func(w ResponseWriter, req *Request) {
+		mu.Lock()
+		body, bodyType, readErr = req.OptBody()
+		mu.Unlock()
+		o := Options{Methods: []string{"REQMOD"}}
+		o.Write(w)
+	}))
+
+	c, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server: %v", err)
+	}
+	defer c.Close()
+	req, err := NewRequest("OPTIONS", "icap://"+l.Addr().String()+"/scan", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.SetOptBody(strings.NewReader("profile"), "X-Vendor-Profile-1.0"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("response is %s (should be 200)", resp.Status)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if readErr != nil {
+		t.Fatalf("error reading opt-body: %v", readErr)
+	}
+	checkString("opt-body", string(body), "profile", t)
+	checkString("Opt-body-type", bodyType, "X-Vendor-Profile-1.0", t)
+
+	req, _ = NewRequest("REQMOD", "icap://icap-server.net/scan", nil, nil)
+	if err := req.SetOptBody(strings.NewReader("profile"), ""); err == nil {
+		t.Error("no error from SetOptBody on a REQMOD request")
+	}
+}
+
+func TestSetTransferPolicy(t *testing.T) {
+	var o Options
+	err := o.SetTransferPolicy(map[string]TransferMode{
+		"zip":  PreviewTransfer,
+		".EXE": PreviewTransfer,
+		"jpg":  IgnoreTransfer,
+		"png":  IgnoreTransfer,
+		"*":    CompleteTransfer,
+	})
+	if err != nil {
+		t.Fatalf("SetTransferPolicy: %v", err)
+	}
+	h := make(http.Header)
+	o.MarshalHeader(h)
+	checkString("Transfer-Preview", h.Get("Transfer-Preview"), "exe, zip", t)
+	checkString("Transfer-Ignore", h.Get("Transfer-Ignore"), "jpg, png", t)
+	checkString("Transfer-Complete", h.Get("Transfer-Complete"), "*", t)
+
+	for _, bad := range []string{"", "tar, gz", "*.zip"} {
+		if err := o.SetTransferPolicy(map[string]TransferMode{bad: IgnoreTransfer}); err == nil {
+			t.Errorf("no error for extension %q", bad)
+		}
+	}
+}
+
+func TestWriteOptions(t *testing.T) {
+	o := &Options{
+		Methods:    []string{"REQMOD"},
+		ISTag:      "\"1\"",
+		Allow204:   true,
+		Preview:    1024,
+		HasPreview: true,
+	}
+	o.SetTransferPolicy(map[string]TransferMode{"exe": PreviewTransfer, "*": CompleteTransfer})
+
+	response := roundTrip("OPTIONS icap://icap-server.net/scan ICAP/1.0\r\n\r\n", HandlerFunc(func(w ResponseWriter, req *Request) {
+		o.Write(w)
+	}), t)
+	for _, h := range []string{
+		"ICAP/1.0 200 OK\r\n",
+		"\r\nAllow: 204\r\n",
+		"\r\nEncapsulated: null-body=0\r\n",
+		"\r\nIstag: \"1\"\r\n",
+		"\r\nMethods: REQMOD\r\n",
+		"\r\nPreview: 1024\r\n",
+		"\r\nTransfer-Complete: *\r\n",
+		"\r\nTransfer-Preview: exe\r\n",
+		"\r\nDate: ",
+	} {
+		if !strings.Contains(response, h) {
+			t.Errorf("Response is %s (should contain %q)", response, h)
+		}
+	}
+	if strings.Contains(response, "Options-Ttl") {
+		t.Errorf("Response is %s (should have no Options-TTL)", response)
+	}
+}
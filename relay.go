@@ -0,0 +1,123 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A handler that passes requests on to another ICAP server.
+
+package icap
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"net/url"
+	"time"
+)
+
+// relayDialTimeout is how long RelayHandler waits to connect to the
+// upstream server.
+const relayDialTimeout = 10 * time.Second
+
+// RelayHandler returns a request handler that passes each request on to
+// the ICAP service at urlStr, such as "icap://upstream.example.com/scan",
+// and answers with that service's response. A connection is made to the
+// upstream server (on port 1344 if urlStr gives none) for each request.
+// If the request's context is canceled (see Request.Context), the
+// connection is cut off.
+//
+// Bodies are streamed through in both directions, a chunk at a time, so
+// memory use does not depend on their size. A preview is passed on as a
+// preview: the rest of the body is only asked for from the client, with
+// "100 Continue", once the upstream service has asked for it in turn.
+// The request is passed on without "Allow: 206", since a partial
+// response could not be relayed. If the upstream service cannot be
+// reached, the answer is 502 Bad Gateway.
+func RelayHandler(urlStr string) Handler {
+	return &relayHandler{urlStr}
+}
+
+type relayHandler struct {
+	url string
+}
+
+func (rh *relayHandler) ServeICAP(w ResponseWriter, req *Request) {
+	u, err := url.Parse(rh.url)
+	if err != nil {
+		serverLogf(w, "icap: relay to %s: %v", rh.url, err)
+		w.WriteHeader(StatusBadGateway, nil, false)
+		return
+	}
+	addr := u.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "1344")
+	}
+	ctx := req.Context()
+	d := net.Dialer{Timeout: relayDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		serverLogf(w, "icap: relay to %s: %v", rh.url, err)
+		w.WriteHeader(StatusBadGateway, nil, false)
+		return
+	}
+	c := NewClient(conn)
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	// The copy shares the body, and the preview state, with req.
+	out := *req
+	out.RawURL = rh.url
+	out.URL = u
+	out.Header = make(textproto.MIMEHeader, len(req.Header))
+	for k, v := range req.Header {
+		out.Header[k] = v
+	}
+	out.Header.Set("Host", u.Host)
+	out.Header.Del("Connection")
+	if req.Allow206() {
+		if req.Allow204() {
+			out.Header.Set("Allow", "204")
+		} else {
+			out.Header.Del("Allow")
+		}
+	}
+
+	resp, err := c.Do(&out)
+	if err != nil {
+		serverLogf(w, "icap: relay to %s: %v", rh.url, err)
+		w.WriteHeader(StatusBadGateway, nil, false)
+		return
+	}
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	// WriteHeader takes the trailer to send from the message, and the
+	// Client fills it in as the body is read.
+	var msg interface{}
+	switch {
+	case resp.Response != nil && resp.bodySection != "req-body":
+		msg = resp.Response
+	case resp.Request != nil:
+		msg = resp.Request
+	}
+	hasBody := resp.body != nil
+	w.WriteHeader(resp.StatusCode, msg, hasBody)
+	if hasBody {
+		if _, err := CopyBody(ctx, w, resp.Body(), 0, nil); err != nil {
+			serverLogf(w, "icap: relay to %s: %v", rh.url, err)
+			abortBody(w, err)
+		}
+	}
+
+	// If the upstream server answered before reading the whole body, the
+	// Client may still be passing it on. Send the answer now, since the
+	// client may not send the rest of the body until it has it; then
+	// Close waits for the Client to stop reading the body, so that the
+	// server can go on to discard what is left of it.
+	if f, ok := w.(Flusher); ok {
+		f.Flush()
+	}
+}
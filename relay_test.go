@@ -0,0 +1,233 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRelayHandler(t *testing.T) {
+	upstream, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer upstream.Close()
+	mux := NewServeMux()
+	mux.HandleFunc("/upper", func(w ResponseWriter, req *Request) {
+		w.Header().Set("ISTag", "\"upper-1\"")
+		w.WriteHeader(http.StatusOK, req.Response, true)
+		io.Copy(w, upperReader{req.Response.Body})
+	})
+	mux.HandleFunc("/skip", func(w ResponseWriter, req *Request) {
+		w.WriteHeader(http.StatusNoContent, nil, false)
+	})
+	go Serve(upstream, mux)
+
+	relay, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer relay.Close()
+	relayMux := NewServeMux()
+	for _, service := range []string{"/upper", "/skip"} {
+		relayMux.Handle(service, RelayHandler("icap://"+upstream.Addr().String()+service))
+	}
+	go Serve(relay, relayMux)
+
+	c, err := Dial(relay.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server: %v", err)
+	}
+	defer c.Close()
+
+	content := strings.Repeat("This is the content. ", 1<<16)
+	for _, tc := range []struct {
+		service string
+		status  int
+		read    int // how much of the body is read, at most
+	}{
+		{"/skip", http.StatusNoContent, 11},
+		{"/upper", http.StatusOK, len(content)},
+	} {
+		body := &countingReader{r: strings.NewReader(content)}
+		httpReq, _ := http.NewRequest("GET", "http://www.origin-server.com/origin-resource", nil)
+		httpResp := &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       ioutil.NopCloser(body),
+		}
+		req, err := NewRequest("RESPMOD", "icap://"+relay.Addr().String()+tc.service, httpReq, httpResp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Preview", "10")
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.service, err)
+		}
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: response is %s (should be %d)", tc.service, resp.Status, tc.status)
+		}
+		got, err := ioutil.ReadAll(resp.Body())
+		if err != nil {
+			t.Fatalf("%s: error reading body: %v", tc.service, err)
+		}
+		if n := body.count(); n > tc.read {
+			t.Errorf("%s: %d bytes of the body were read (should be at most %d)", tc.service, n, tc.read)
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		checkString("ISTag", resp.Header.Get("ISTag"), "\"upper-1\"", t)
+		checkString("Content-Type", resp.Response.Header.Get("Content-Type"), "text/plain", t)
+		if string(got) != strings.ToUpper(content) {
+			t.Errorf("%s: body is %d bytes (should be the %d bytes sent, in upper case)", tc.service, len(got), len(content))
+		}
+	}
+}
+
+func TestRelayHandlerEarlyAnswer(t *testing.T) {
+	// The upstream service blocks the request without reading its body,
+	// while the relay is still passing the body on.
+	upstream, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer upstream.Close()
+	go Serve(upstream, HandlerFunc(func(w ResponseWriter, req *Request) {
+		SatisfyWithResponse(w, BlockResponse(http.StatusForbidden, nil, "text/plain"), false)
+	}))
+
+	relay, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer relay.Close()
+	go Serve(relay, RelayHandler("icap://"+upstream.Addr().String()+"/block"))
+
+	c, err := Dial(relay.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server: %v", err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		// The rest of the body is held back until the answer arrives, so
+		// the relay is still reading it when the answer is relayed. The
+		// first part fills the buffers, so that the header is sent.
+		gate := make(chan bool)
+		body := io.MultiReader(strings.NewReader(strings.Repeat("x", 64<<10)), gateReader{gate, strings.NewReader(strings.Repeat("x", 100<<10))})
+		httpReq, _ := http.NewRequest("POST", "http://www.origin-server.com/upload", body)
+		req, err := NewRequest("REQMOD", "icap://"+relay.Addr().String()+"/block", httpReq, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		close(gate)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if resp.Response == nil || resp.Response.StatusCode != http.StatusForbidden {
+			t.Fatalf("request %d: response is %s, with HTTP response %v (should be a 403)", i, resp.Status, resp.Response)
+		}
+		ioutil.ReadAll(resp.Body())
+	}
+}
+
+func TestRelayHandlerTrailer(t *testing.T) {
+	upstream, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer upstream.Close()
+	go Serve(upstream, HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.WriteHeader(http.StatusOK, req.Response, true)
+		io.Copy(w, req.Response.Body)
+		req.Response.Trailer = http.Header{"X-Checksum": {"1234"}}
+	}))
+
+	relay, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer relay.Close()
+	go Serve(relay, RelayHandler("icap://"+upstream.Addr().String()+"/server"))
+
+	c, err := Dial(relay.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server: %v", err)
+	}
+	defer c.Close()
+
+	httpResp := &http.Response{
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       ioutil.NopCloser(strings.NewReader("hello")),
+	}
+	req, err := NewRequest("RESPMOD", "icap://"+relay.Addr().String()+"/server", nil, httpResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(resp.Body())
+	if err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	checkString("Body", string(got), "hello", t)
+	checkString("X-Checksum", resp.Response.Trailer.Get("X-Checksum"), "1234", t)
+}
+
+func TestRelayHandlerUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	response := roundTrip("REQMOD icap://icap-server.net/server ICAP/1.0\r\n"+
+		"Host: icap-server.net\r\n"+
+		"Encapsulated: req-hdr=0, null-body=62\r\n"+
+		"\r\n"+
+		"GET /origin-resource HTTP/1.1\r\n"+
+		"Host: www.origin-server.com\r\n"+
+		"\r\n", RelayHandler("icap://"+addr+"/server"), t)
+	if !strings.HasPrefix(response, "ICAP/1.0 502 Bad Gateway\r\n") {
+		t.Errorf("Response is %s (should be a 502)", response)
+	}
+}
+
+// A gateReader reads from r once gate is closed.
+type gateReader struct {
+	gate chan bool
+	r    io.Reader
+}
+
+func (g gateReader) Read(p []byte) (int, error) {
+	<-g.gate
+	return g.r.Read(p)
+}
+
+// An upperReader converts what it reads to upper case.
+type upperReader struct {
+	r io.Reader
+}
+
+func (u upperReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	copy(p, bytes.ToUpper(p[:n]))
+	return n, err
+}
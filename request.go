@@ -10,12 +10,16 @@ package icap
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/textproto"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 )
@@ -27,41 +31,266 @@ type badStringError struct {
 
 func (e *badStringError) Error() string { return fmt.Sprintf("%s %q", e.what, e.str) }
 
+// A requestError is an error in an incoming request that should be
+// reported to the client with an ICAP status code.
+type requestError struct {
+	code int
+	msg  string
+}
+
+func (e *requestError) Error() string { return e.msg }
+
+// An HTTPParseError is returned by ReadRequest when an encapsulated HTTP
+// header is malformed. The server answers such requests with 400 Bad Request.
+type HTTPParseError struct {
+	Kind string // which header was malformed: "request" or "response"
+	Err  error  // the error from the net/http parser
+}
+
+func (e *HTTPParseError) Error() string {
+	return fmt.Sprintf("error while parsing HTTP %s: %v", e.Kind, e.Err)
+}
+
 // A Request represents a parsed ICAP request.
 type Request struct {
-	Method     string               // REQMOD, RESPMOD, OPTIONS, etc.
-	RawURL     string               // The URL given in the request.
-	URL        *url.URL             // Parsed URL.
-	Proto      string               // The protocol version.
-	Header     textproto.MIMEHeader // The ICAP header
-	RemoteAddr string               // the address of the computer sending the request
-	Preview    []byte               // the body data for an ICAP preview
+	Method      string               // REQMOD, RESPMOD, OPTIONS, etc.
+	RawURL      string               // The URL given in the request.
+	URL         *url.URL             // Parsed URL.
+	Proto       string               // The protocol version.
+	Header      textproto.MIMEHeader // The ICAP header
+	RemoteAddr  string               // the address of the computer sending the request
+	Preview     []byte               // the body data for an ICAP preview
+	PreviewSize int                  // the size given in the Preview header; -1 if there is none
+	Close       bool                 // the client sent "Connection: close"
+
+	// ConnRequestNum is the position of this request among those
+	// received on its connection, starting at 1. It is set by the Server.
+	ConnRequestNum int
+
+	// PreviewExtension is the chunk extension, if any, on the 0-length
+	// chunk that ended the preview, without the leading semicolon.
+	// PreviewEOF is true if it included "ieof", meaning that Preview
+	// holds the entire body and no more will follow.
+	PreviewExtension string
+	PreviewEOF       bool
 
 	// The HTTP messages.
 	Request  *http.Request
 	Response *http.Response
+
+	// RawReqHdr and RawRespHdr are the encapsulated HTTP headers exactly
+	// as they were received, including the blank line that ends them;
+	// Request and Response are parsed from them. They are nil if the
+	// request did not include that header.
+	RawReqHdr  []byte
+	RawRespHdr []byte
+
+	bodySection string          // the last Encapsulated section: req-body, res-body, opt-body, or null-body
+	cont        *continueReader // reads the body after the preview, if there is more
+	chunks      *chunkedReader  // reads the body, if there is no preview
+	body        io.ReadCloser   // the encapsulated body, whichever message it belongs to
+	tempFiles   *[]*os.File     // files created by SpillBody, removed when the request is done
+	args        url.Values      // the parsed query, cached by ServiceArgs
+	ctx         context.Context // the request's context; see Context
+	remoteAddr  net.Addr        // the connection's remote address; see RemoteNetAddr
+	localAddr   net.Addr        // the connection's local address; see LocalAddr
+}
+
+// A BodyType identifies the Encapsulated section that carries
+// the body of a request.
+type BodyType int
+
+const (
+	NullBody BodyType = iota // no body
+	ReqBody                  // the body of the HTTP request
+	ResBody                  // the body of the HTTP response
+	OptBody                  // the body of an OPTIONS request
+)
+
+// BodyType returns the type of body encapsulated in req.
+func (req *Request) BodyType() BodyType {
+	switch req.bodySection {
+	case "req-body":
+		return ReqBody
+	case "res-body":
+		return ResBody
+	case "opt-body":
+		return OptBody
+	}
+	return NullBody
+}
+
+// PreviewIsEOF reports whether the preview ended with "0; ieof", so
+// that it holds the whole body; it is the same as req.PreviewEOF. When
+// it is true, the client expects no "100 Continue", and none is sent.
+func (req *Request) PreviewIsEOF() bool {
+	return req.PreviewEOF
+}
+
+// RemoteNetAddr returns the address of the client that sent the
+// request, as the connection reports it; RemoteAddr is its String form.
+// For a TCP connection it is a *net.TCPAddr, so the client's IP
+// address can be checked without parsing. It is nil for a request that
+// was not received by a Server.
+func (req *Request) RemoteNetAddr() net.Addr {
+	return req.remoteAddr
+}
+
+// LocalAddr returns the server's address on the connection the request
+// was received on, or nil for a request that was not received by a
+// Server. When a server listens on several addresses, it tells which
+// one the client connected to.
+func (req *Request) LocalAddr() net.Addr {
+	return req.localAddr
+}
+
+// Allow204 reports whether the client sent "Allow: 204", so that it
+// accepts 204 No Modifications outside a preview. Otherwise, an
+// unmodified message must be sent back in full; see Forward.
+func (req *Request) Allow204() bool {
+	return hasToken(req.Header["Allow"], "204")
+}
+
+// Allow206 reports whether the client sent "Allow: 206", so that it
+// accepts 206 Partial Content responses, which send only the start of
+// a modified body and have the client take the rest from the original
+// body. See WritePartial.
+func (req *Request) Allow206() bool {
+	return hasToken(req.Header["Allow"], "206")
+}
+
+// ServiceArgs returns the arguments to the service from the query of
+// the request URL, such as mode=strict in
+// icap://icap.example.net/scan?mode=strict. They are parsed on the first
+// call; malformed pairs are skipped. The result is shared by later
+// calls, so it should not be modified.
+func (req *Request) ServiceArgs() url.Values {
+	if req.args == nil {
+		if req.URL != nil {
+			req.args, _ = url.ParseQuery(req.URL.RawQuery)
+		}
+		if req.args == nil {
+			req.args = make(url.Values)
+		}
+	}
+	return req.args
+}
+
+// Body returns the encapsulated body, whichever section carried it.
+// For a ReqBody in REQMOD it is the same as req.Request.Body, and for a
+// ResBody in RESPMOD the same as req.Response.Body.
+// If there is no body, it returns http.NoBody.
+func (req *Request) Body() io.ReadCloser {
+	if req.body == nil {
+		return http.NoBody
+	}
+	return req.body
+}
+
+// setBody replaces the body reader, in the HTTP message as well.
+func (req *Request) setBody(body io.ReadCloser) {
+	req.body = body
+	switch {
+	case req.Method == "REQMOD" && req.Request != nil:
+		req.Request.Body = body
+	case req.Method == "RESPMOD" && req.Response != nil:
+		req.Response.Body = body
+	}
+}
+
+// maxDrainBytes is the most body data that is read and discarded after
+// a response, to keep the connection open for another request.
+const maxDrainBytes = 256 << 10
+
+// drainBody reads and discards whatever the handler left unread of the
+// body, so that the next request can be read from the connection. It
+// reports whether that succeeded.
+func (req *Request) drainBody() bool {
+	if req.body == nil {
+		return true
+	}
+	if req.cont != nil && req.cont.cr == nil {
+		// The response came during the preview, so the client won't
+		// send the rest of the body.
+		return true
+	}
+	_, err := io.CopyN(ioutil.Discard, req.body, maxDrainBytes+1)
+	return err == io.EOF
 }
 
 // ReadRequest reads and parses a request from b.
+// If b is at EOF before the request begins, ReadRequest returns io.EOF.
+//
+// b.Reader may already have data buffered, or may have been partly
+// consumed (for example by peeking at the first bytes to detect the
+// protocol); ReadRequest picks up at the current read position. The
+// body is read from b.Reader directly, so no data is lost between the
+// headers and the body, and nothing past the end of the body is consumed.
 func ReadRequest(b *bufio.ReadWriter) (req *Request, err error) {
-	tp := textproto.NewReader(b.Reader)
+	return readRequest(b, nil)
+}
+
+// ParseRequestBytes parses the complete ICAP request in data, including
+// the rest of the body after any preview, for fuzzers, linters, and
+// other tools working on captured messages. Unlike ReadRequest, it
+// reads the whole body into memory, so the Request no longer depends
+// on data. It is an error for data to continue after the request.
+func ParseRequestBytes(data []byte) (*Request, error) {
+	br := bufio.NewReader(bytes.NewReader(data))
+	req, err := ReadRequest(bufio.NewReadWriter(br, bufio.NewWriter(ioutil.Discard)))
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(req.Body())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := br.Peek(1); err != io.EOF {
+		return nil, errors.New("icap: data after end of request")
+	}
+
+	req.body = ioutil.NopCloser(bytes.NewReader(body))
+	if req.Request != nil && req.Method == "REQMOD" {
+		req.Request.Body = req.body
+	}
+	if req.Response != nil && req.Method == "RESPMOD" {
+		req.Response.Body = req.body
+	}
+	return req, nil
+}
+
+// readRequest reads a request from b, enforcing the limits configured on srv.
+// srv may be nil.
+func readRequest(b *bufio.ReadWriter, srv *Server) (*Request, error) {
+	req, err := readRequestHeader(b.Reader, srv)
+	if err != nil {
+		return nil, err
+	}
+	if err := readEncapsulated(req, b, srv); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// readRequestHeader reads the request line and the ICAP header of a
+// request from br.
+func readRequestHeader(br *bufio.Reader, srv *Server) (req *Request, err error) {
+	tp := textproto.NewReader(br)
 	req = new(Request)
 
 	// Read first line.
 	var s string
 	s, err = tp.ReadLine()
 	if err != nil {
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
-		}
+		// io.EOF here means the stream ended cleanly, before the request started.
 		return nil, err
 	}
 
-	f := strings.SplitN(s, " ", 3)
-	if len(f) < 3 {
+	var ok bool
+	req.Method, req.RawURL, req.Proto, ok = parseRequestLine(s)
+	if !ok {
 		return nil, &badStringError{"malformed ICAP request", s}
 	}
-	req.Method, req.RawURL, req.Proto = f[0], f[1], f[2]
 
 	req.URL, err = url.ParseRequestURI(req.RawURL)
 	if err != nil {
@@ -70,166 +299,621 @@ func ReadRequest(b *bufio.ReadWriter) (req *Request, err error) {
 
 	req.Header, err = tp.ReadMIMEHeader()
 	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, err
 	}
-
-	s = req.Header.Get("Encapsulated")
-	if s == "" {
-		return req, nil // No HTTP headers or body.
-	}
-	eList := strings.Split(s, ", ")
-	var initialOffset, reqHdrLen, respHdrLen int
-	var hasBody bool
-	var prevKey string
-	var prevValue int
-	for _, item := range eList {
-		eq := strings.Index(item, "=")
-		if eq == -1 {
-			return nil, &badStringError{"malformed Encapsulated: header", s}
+	if srv != nil && srv.MaxICAPHeaders > 0 {
+		n := 0
+		for _, v := range req.Header {
+			n += len(v)
 		}
-		key := item[:eq]
-		value, err := strconv.Atoi(item[eq+1:])
-		if err != nil {
-			return nil, &badStringError{"malformed Encapsulated: header", s}
+		if n > srv.MaxICAPHeaders {
+			return nil, &requestError{http.StatusBadRequest, "too many ICAP header fields"}
 		}
+	}
 
-		// Calculate the length of the previous section.
-		switch prevKey {
-		case "":
-			initialOffset = value
-		case "req-hdr":
-			reqHdrLen = value - prevValue
-		case "res-hdr":
-			respHdrLen = value - prevValue
-		case "req-body", "opt-body", "res-body", "null-body":
-			return nil, fmt.Errorf("%s must be the last section", prevKey)
-		}
+	req.Close = hasToken(req.Header["Connection"], "close")
 
-		switch key {
-		case "req-hdr", "res-hdr", "null-body":
-		case "req-body", "res-body", "opt-body":
-			hasBody = true
-		default:
-			return nil, &badStringError{"invalid key for Encapsulated: header", key}
+	req.PreviewSize = -1
+	if p := req.Header.Get("Preview"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, &badStringError{"malformed Preview: header", p}
 		}
-
-		prevValue = value
-		prevKey = key
+		if srv != nil && n > srv.maxPreviewBytes() {
+			return nil, &requestError{http.StatusBadRequest, "preview too large"}
+		}
+		req.PreviewSize = n
 	}
 
-	// Read the HTTP headers.
-	var rawReqHdr, rawRespHdr []byte
-	if initialOffset > 0 {
-		junk := make([]byte, initialOffset)
-		_, err = io.ReadFull(b, junk)
-		if err != nil {
-			return nil, err
-		}
+	return req, nil
+}
+
+// readEncapsulated reads the encapsulated HTTP headers of req, and any
+// preview, from b, and sets up the body to be read from b.
+func readEncapsulated(req *Request, b *bufio.ReadWriter, srv *Server) (err error) {
+	s := req.Header.Get("Encapsulated")
+	if s == "" {
+		return nil // No HTTP headers or body.
 	}
-	if reqHdrLen > 0 {
-		rawReqHdr = make([]byte, reqHdrLen)
-		_, err = io.ReadFull(b, rawReqHdr)
-		if err != nil {
-			return nil, err
-		}
+	var buf [4]encapSection
+	sections, err := parseEncapsulated(buf[:0], s)
+	if err != nil {
+		return err
 	}
-	if respHdrLen > 0 {
-		rawRespHdr = make([]byte, respHdrLen)
-		_, err = io.ReadFull(b, rawRespHdr)
-		if err != nil {
-			return nil, err
-		}
+	if last := sections[len(sections)-1].key; (last == "req-hdr" || last == "res-hdr") && srv != nil && srv.StrictEncapsulated {
+		return &requestError{http.StatusBadRequest, "Encapsulated header has no body section"}
+	}
+
+	rawReqHdr, rawRespHdr, bodySection, err := readSections(b.Reader, sections, s, srv.maxHeaderBytes())
+	if err != nil {
+		return err
 	}
+	req.bodySection = bodySection
+	req.RawReqHdr, req.RawRespHdr = rawReqHdr, rawRespHdr
+	hasBody := bodySection != "null-body"
 
-	var bodyReader io.ReadCloser = emptyReader(0)
+	// The trailer of the body belongs in the HTTP message that is
+	// constructed below, but a trailer after the preview has been read
+	// by then.
+	var previewTrailer *http.Header
+
+	var bodyReader io.ReadCloser = http.NoBody
 	if hasBody {
-		if p := req.Header.Get("Preview"); p != "" {
-			moreBody := true
-			req.Preview, err = ioutil.ReadAll(newChunkedReader(b))
+		if req.PreviewSize >= 0 {
+			// The preview ends with a zero-length chunk, even if it is
+			// empty (Preview: 0), or holds the whole body ("0; ieof").
+			cr := newChunkedReader(b.Reader)
+			previewTrailer = new(http.Header)
+			cr.trailer = previewTrailer
+			req.Preview, err = ioutil.ReadAll(io.LimitReader(cr, int64(req.PreviewSize)+1))
 			if err != nil {
-				if strings.Contains(err.Error(), "ieof") {
-					// The data ended with "0; ieof", which the HTTP chunked reader doesn't understand.
-					moreBody = false
-					err = nil
-				} else {
-					return nil, err
-				}
+				return err
+			}
+			if len(req.Preview) > req.PreviewSize {
+				return &requestError{http.StatusBadRequest, "preview longer than Preview header"}
 			}
+			req.PreviewExtension = cr.ext
+			// "0; ieof" means the preview holds the whole body.
+			req.PreviewEOF = hasChunkExtension(cr.ext, "ieof")
+
 			var r io.Reader = bytes.NewBuffer(req.Preview)
-			if moreBody {
-				r = io.MultiReader(r, &continueReader{buf: b})
+			if !req.PreviewEOF {
+				req.cont = &continueReader{buf: b, proto: srv.proto()}
+				r = io.MultiReader(r, req.cont)
 			}
 			bodyReader = ioutil.NopCloser(r)
 		} else {
-			bodyReader = ioutil.NopCloser(newChunkedReader(b))
+			req.chunks = newChunkedReader(b.Reader)
+			bodyReader = ioutil.NopCloser(req.chunks)
+		}
+	}
+
+	req.body = bodyReader
+
+	if srv != nil && srv.StrictHTTP {
+		for _, raw := range [][]byte{rawReqHdr, rawRespHdr} {
+			if raw == nil {
+				continue
+			}
+			if err = checkFraming(raw); err != nil {
+				return err
+			}
 		}
 	}
 
 	// Construct the http.Request.
 	if rawReqHdr != nil {
-		req.Request, err = http.ReadRequest(bufio.NewReader(bytes.NewBuffer(rawReqHdr)))
+		req.Request, err = http.ReadRequest(newHeaderReader(rawReqHdr))
 		if err != nil {
-			return nil, fmt.Errorf("error while parsing HTTP request: %v", err)
+			return &HTTPParseError{Kind: "request", Err: err}
 		}
 
-		if req.Method == "REQMOD" {
+		// An HTTP message without an encapsulated body gets http.NoBody
+		// and a ContentLength of 0, whatever its headers say, so that it
+		// can be passed to functions like httputil.DumpRequest.
+		if req.Method == "REQMOD" && hasBody {
 			req.Request.Body = bodyReader
 		} else {
-			req.Request.Body = emptyReader(0)
+			req.Request.Body = http.NoBody
+			req.Request.ContentLength = 0
 		}
 	}
 
 	// Construct the http.Response.
 	if rawRespHdr != nil {
+		// ReadResponse needs the request to know how the response is
+		// framed; a response to HEAD has no body, whatever its headers
+		// say. Without a req-hdr section, the method is taken to be GET.
 		request := req.Request
 		if request == nil {
 			request, _ = http.NewRequest("GET", "/", nil)
 		}
-		req.Response, err = http.ReadResponse(bufio.NewReader(bytes.NewBuffer(rawRespHdr)), request)
+		req.Response, err = http.ReadResponse(newHeaderReader(rawRespHdr), request)
 		if err != nil {
-			return nil, fmt.Errorf("error while parsing HTTP response: %v", err)
+			return &HTTPParseError{Kind: "response", Err: err}
 		}
 
-		if req.Method == "RESPMOD" {
+		// A response that has no body by HTTP's rules, such as one to
+		// HEAD, already has http.NoBody; its ContentLength is kept, as
+		// ReadResponse leaves it.
+		if req.Method == "RESPMOD" && hasBody {
 			req.Response.Body = bodyReader
+		} else if req.Response.Body != http.NoBody {
+			req.Response.Body = http.NoBody
+			req.Response.ContentLength = 0
+		}
+	}
+
+	if trailer := req.bodyTrailer(); trailer != nil {
+		if previewTrailer != nil && *previewTrailer != nil {
+			if *trailer == nil {
+				*trailer = make(http.Header)
+			}
+			for k, vv := range *previewTrailer {
+				(*trailer)[k] = append((*trailer)[k], vv...)
+			}
+		}
+		if req.chunks != nil {
+			req.chunks.trailer = trailer
+		}
+		if req.cont != nil {
+			req.cont.trailer = trailer
+		}
+	}
+
+	return nil
+}
+
+// bodyTrailer returns a pointer to the Trailer field of the HTTP message
+// that the encapsulated body belongs to, or nil if there is none.
+func (req *Request) bodyTrailer() *http.Header {
+	switch {
+	case req.bodySection == "req-body" && req.Request != nil:
+		return &req.Request.Trailer
+	case req.bodySection == "res-body" && req.Response != nil:
+		return &req.Response.Trailer
+	}
+	return nil
+}
+
+// errEncapsulatedTooLarge is returned by readSections when the
+// encapsulated HTTP headers are longer than its limit.
+var errEncapsulatedTooLarge = &requestError{http.StatusBadRequest, "encapsulated HTTP headers too large"}
+
+// readSections reads the encapsulated HTTP headers described by
+// sections (from the Encapsulated header encap) from br, leaving br at
+// the start of the body. It returns the raw headers, either of which may
+// be nil, and the name of the body section. The headers together may be
+// no longer than limit bytes.
+func readSections(br *bufio.Reader, sections []encapSection, encap string, limit int) (rawReqHdr, rawRespHdr []byte, bodySection string, err error) {
+	// Read the HTTP headers, in the order they appear in the message.
+	pos := 0
+	for i, sec := range sections {
+		if sec.offset > pos {
+			if _, err = br.Discard(sec.offset - pos); err != nil {
+				return nil, nil, "", err
+			}
+			pos = sec.offset
+		}
+
+		switch sec.key {
+		case "req-body", "res-body", "opt-body", "null-body":
+			bodySection = sec.key
+			continue
+		}
+
+		// Header sections run up to the start of the next section.
+		var raw []byte
+		if i == len(sections)-1 {
+			// Some clients leave out the null-body section after the
+			// last header; the header ends with the first blank line.
+			if raw, err = readHeaderBlock(br, limit); err != nil {
+				return nil, nil, "", err
+			}
+			bodySection = "null-body"
+		} else {
+			// parseEncapsulated has checked that offsets increase, so
+			// the section is not empty. The offsets come from the
+			// client, so check the length before allocating it.
+			n := sections[i+1].offset - sec.offset
+			if n > limit {
+				return nil, nil, "", errEncapsulatedTooLarge
+			}
+			raw = make([]byte, n)
+			if _, err = io.ReadFull(br, raw); err != nil {
+				return nil, nil, "", err
+			}
+			// The next section must start right after the blank line
+			// that ends this header.
+			if headerLength(raw) != len(raw) {
+				return nil, nil, "", &badStringError{"Encapsulated: " + sections[i+1].key + " offset does not match the end of " + sec.key + " in", encap}
+			}
+		}
+		pos += len(raw)
+		limit -= len(raw)
+		if sec.key == "req-hdr" {
+			rawReqHdr = raw
 		} else {
-			req.Response.Body = emptyReader(0)
+			rawRespHdr = raw
+		}
+	}
+
+	// br should now be positioned exactly at the start of the body.
+	// Check that it looks like the chunk-size line, to catch offsets
+	// that don't match the data before they cause confusing errors.
+	if bodySection != "null-body" {
+		c, err := br.Peek(1)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		if !isHexDigit(c[0]) {
+			return nil, nil, "", &badStringError{"Encapsulated: header does not match start of body", encap}
+		}
+	}
+	return rawReqHdr, rawRespHdr, bodySection, nil
+}
+
+// headerLength returns the length of the HTTP header at the start of
+// raw, through the blank line that ends it, or -1 if it has no end.
+func headerLength(raw []byte) int {
+	for i := 0; i < len(raw); {
+		j := bytes.IndexByte(raw[i:], '\n')
+		if j < 0 {
+			return -1
+		}
+		line := raw[i : i+j]
+		i += j + 1
+		if len(line) == 0 || len(line) == 1 && line[0] == '\r' {
+			return i
+		}
+	}
+	return -1
+}
+
+// readHeaderBlock reads an HTTP header from br, up to and including
+// the blank line that ends it. If the header is longer than limit
+// bytes, it returns errEncapsulatedTooLarge.
+func readHeaderBlock(br *bufio.Reader, limit int) ([]byte, error) {
+	var raw []byte
+	for {
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, errors.New("header line too long")
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if len(raw)+len(line) > limit {
+			return nil, errEncapsulatedTooLarge
+		}
+		raw = append(raw, line...)
+		if len(line) <= 2 && strings.TrimRight(string(line), "\r\n") == "" {
+			return raw, nil
 		}
 	}
+}
+
+// maxEncapsulatedEntries is the most entries allowed in an Encapsulated
+// header. A valid header never has more than three.
+const maxEncapsulatedEntries = 8
 
-	return
+// An encapSection is one entry from an Encapsulated header.
+type encapSection struct {
+	key    string // req-hdr, res-hdr, req-body, etc.
+	offset int    // offset from the start of the encapsulated data
 }
 
-// An emptyReader is an io.ReadCloser that always returns os.EOF.
-type emptyReader byte
+// parseEncapsulated parses the value of an Encapsulated header,
+// appending the sections to dst.
+// The sections may be listed in any order; they are returned sorted by
+// offset, so that the length of each section is the distance to the next one.
+func parseEncapsulated(dst []encapSection, s string) ([]encapSection, error) {
+	if strings.Count(s, ",") >= maxEncapsulatedEntries {
+		return nil, &badStringError{"too many entries in Encapsulated: header", s}
+	}
+
+	sections := dst
+	for rest := s; rest != ""; {
+		// Walk the list in place rather than splitting it, to save an
+		// allocation on every request.
+		item := rest
+		if comma := strings.IndexByte(rest, ','); comma != -1 {
+			item, rest = rest[:comma], rest[comma+1:]
+		} else {
+			rest = ""
+		}
+		item = strings.TrimSpace(item)
+
+		eq := strings.Index(item, "=")
+		if eq == -1 {
+			return nil, &badStringError{"malformed Encapsulated: header", s}
+		}
+		key := item[:eq]
+		value, err := strconv.Atoi(item[eq+1:])
+		if err != nil || value < 0 {
+			return nil, &badStringError{"malformed Encapsulated: header", s}
+		}
+
+		switch key {
+		case "req-hdr", "res-hdr", "req-body", "res-body", "opt-body", "null-body":
+		default:
+			return nil, &badStringError{"invalid key for Encapsulated: header", key}
+		}
+
+		// Insert in order of offset; there are never more than a few entries.
+		i := len(sections)
+		sections = append(sections, encapSection{})
+		for i > 0 && sections[i-1].offset > value {
+			sections[i] = sections[i-1]
+			i--
+		}
+		sections[i] = encapSection{key, value}
+	}
+
+	for i, sec := range sections {
+		// Each section must be longer than zero bytes, so no two may
+		// start at the same offset.
+		if i > 0 && sec.offset <= sections[i-1].offset {
+			return nil, &badStringError{"Encapsulated: header offsets do not increase", s}
+		}
+		switch sec.key {
+		case "req-body", "res-body", "opt-body", "null-body":
+			if i != len(sections)-1 {
+				return nil, fmt.Errorf("%s must be the last section", sec.key)
+			}
+		}
+	}
 
-func (emptyReader) Read(p []byte) (n int, err error) {
-	return 0, io.EOF
+	return sections, nil
 }
 
-func (emptyReader) Close() error {
+// checkFraming checks the raw header of an encapsulated HTTP message for
+// combinations of framing headers that different HTTP implementations
+// may interpret differently, allowing request smuggling. The net/http
+// parser resolves some of these silently, so the raw header is checked.
+func checkFraming(raw []byte) error {
+	tp := textproto.NewReader(newHeaderReader(raw))
+	if _, err := tp.ReadLine(); err != nil {
+		return err
+	}
+	h, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(h["Content-Length"]) > 1:
+		return &requestError{http.StatusBadRequest, "multiple Content-Length headers in HTTP message"}
+	case len(h["Content-Length"]) > 0 && len(h["Transfer-Encoding"]) > 0:
+		return &requestError{http.StatusBadRequest, "both Content-Length and Transfer-Encoding in HTTP message"}
+	}
 	return nil
 }
 
-// A continueReader sends a "100 Continue" message the first time Read
-// is called, creates a ChunkedReader, and reads from that.
-type continueReader struct {
-	buf *bufio.ReadWriter // the underlying connection
-	cr  io.Reader         // the ChunkedReader
+// hasToken reports whether token appears, ignoring case, in the
+// comma-separated header values.
+func hasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func (c *continueReader) Read(p []byte) (n int, err error) {
-	if c.cr == nil {
-		_, err := c.buf.WriteString("ICAP/1.0 100 Continue\r\n\r\n")
-		if err != nil {
+// parseRequestLine parses "REQMOD icap://foo/bar ICAP/1.0" into its three parts.
+func parseRequestLine(line string) (method, requestURI, proto string, ok bool) {
+	s1 := strings.IndexByte(line, ' ')
+	if s1 < 0 {
+		return
+	}
+	s2 := strings.IndexByte(line[s1+1:], ' ')
+	if s2 < 0 {
+		return
+	}
+	s2 += s1 + 1
+	return line[:s1], line[s1+1 : s2], line[s2+1:], true
+}
+
+// newHeaderReader returns a bufio.Reader for parsing the HTTP header in hdr.
+// The buffer is sized to the header instead of the 4k default,
+// since the whole header is already in memory.
+func newHeaderReader(hdr []byte) *bufio.Reader {
+	return bufio.NewReaderSize(bytes.NewReader(hdr), len(hdr))
+}
+
+// WriteTo writes req to w in ICAP wire format: the request line, the ICAP
+// header, the encapsulated HTTP headers, and the body, if any. The ICAP
+// header is written as it stands in req.Header, so a relay can edit it
+// (adding a Via header, for example) before forwarding the request; but
+// the Encapsulated header is recomputed from the HTTP messages.
+//
+// If there is a Preview header, only the preview is written: req.Preview,
+// or for a request not read by ReadRequest, the number of bytes of the
+// body that the header gives. Unless it holds the whole body, and ends
+// with "0; ieof", RFC 3507 has the client wait for the server to answer
+// "100 Continue" before it sends the rest with WriteRest; the server may
+// instead answer straight away, and the rest is not sent at all.
+//
+// WriteTo consumes the body, or the preview.
+func (req *Request) WriteTo(w io.Writer) (n int64, err error) {
+	if err := req.takePreview(); err != nil {
+		return 0, err
+	}
+
+	var reqHdr, respHdr []byte
+	if req.Request != nil {
+		if reqHdr, err = httpRequestHeader(req.Request); err != nil {
 			return 0, err
 		}
-		err = c.buf.Flush()
-		if err != nil {
+	}
+	if req.Response != nil {
+		if respHdr, err = httpResponseHeader(req.Response); err != nil {
 			return 0, err
 		}
-		c.cr = newChunkedReader(c.buf)
 	}
+	bodyKey := req.bodySection
+	if bodyKey == "" {
+		bodyKey = "null-body"
+	}
+
+	h := make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		h[k] = v
+	}
+	delete(h, "Encapsulated")
+	if req.bodySection != "" || reqHdr != nil || respHdr != nil {
+		h.Set("Encapsulated", encapsulatedHeader(reqHdr, respHdr, bodyKey))
+	}
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	fmt.Fprintf(bw, "%s %s %s\r\n", req.Method, req.RawURL, req.Proto)
+	h.Write(bw)
+	bw.WriteString("\r\n")
+	bw.Write(reqHdr)
+	bw.Write(respHdr)
+
+	if t := req.BodyType(); t != NullBody {
+		body := req.Body()
+		chunked := &chunkedWriter{Wire: bw}
+		if req.Header.Get("Preview") != "" {
+			if _, err = io.CopyN(chunked, body, int64(len(req.Preview))); err != nil {
+				return cw.n, err
+			}
+			if !req.PreviewEOF {
+				bw.WriteString("0\r\n\r\n")
+				err = bw.Flush()
+				return cw.n, err
+			}
+			chunked.lastExt = "ieof"
+		} else if _, err = io.Copy(chunked, body); err != nil {
+			return cw.n, err
+		}
+		if t := req.bodyTrailer(); t != nil {
+			chunked.trailer = *t
+		}
+		chunked.finish()
+	}
+
+	err = bw.Flush()
+	return cw.n, err
+}
 
+// WriteRest writes the rest of the body of req after the preview that
+// WriteTo has written, in chunked encoding, once the server has answered
+// "100 Continue". If req was read from a client that is waiting for the
+// same answer, reading the rest of the body sends it "100 Continue".
+func (req *Request) WriteRest(w io.Writer) (n int64, err error) {
+	if req.Header.Get("Preview") == "" || req.PreviewEOF || req.BodyType() == NullBody {
+		return 0, errors.New("icap: WriteRest: no more body after the preview")
+	}
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	chunked := &chunkedWriter{Wire: bw}
+	if _, err = io.Copy(chunked, req.Body()); err != nil {
+		return cw.n, err
+	}
+	if t := req.bodyTrailer(); t != nil {
+		chunked.trailer = *t
+	}
+	chunked.finish()
+	err = bw.Flush()
+	return cw.n, err
+}
+
+// takePreview reads the preview that the Preview header asks for from
+// the body of a request that was not read by ReadRequest, such as one
+// made by NewRequest, setting Preview, PreviewSize, and PreviewEOF.
+func (req *Request) takePreview() error {
+	p := req.Header.Get("Preview")
+	if p == "" || req.PreviewSize >= 0 || req.Preview != nil {
+		return nil
+	}
+	n, err := strconv.Atoi(p)
+	if err != nil || n < 0 {
+		return &badStringError{"malformed Preview: header", p}
+	}
+	req.PreviewSize = n
+	if req.BodyType() == NullBody {
+		return nil
+	}
+
+	// Read one byte more, to find out whether the preview is the whole
+	// body, and put it back in front of the rest.
+	body := req.Body()
+	buf := make([]byte, n+1)
+	m, err := io.ReadFull(body, buf)
+	switch err {
+	case nil:
+		req.Preview = buf[:n]
+	case io.EOF, io.ErrUnexpectedEOF:
+		req.Preview = buf[:m]
+		req.PreviewEOF = true
+		req.PreviewExtension = "ieof"
+	default:
+		return err
+	}
+	req.setBody(decodedBody{io.MultiReader(bytes.NewReader(buf[:m]), body), body})
+	return nil
+}
+
+// A countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// errContinueAfterResponse is returned when reading past the preview
+// of a request whose response has already begun.
+var errContinueAfterResponse = errors.New("icap: read past the preview after the response header was written")
+
+// A continueReader sends a "100 Continue" message the first time Read
+// is called, creates a ChunkedReader, and reads from that.
+type continueReader struct {
+	buf       *bufio.ReadWriter // the underlying connection
+	proto     string            // the protocol version for the status line
+	cr        *chunkedReader    // the ChunkedReader
+	trailer   *http.Header      // where the ChunkedReader puts the trailer
+	responded bool              // the response header has been written, so "100 Continue" can't be
+}
+
+func (c *continueReader) Read(p []byte) (n int, err error) {
+	if err = c.start(); err != nil {
+		return 0, err
+	}
 	return c.cr.Read(p)
 }
+
+// start sends "100 Continue", if it has not been sent already.
+func (c *continueReader) start() error {
+	if c.cr != nil {
+		return nil
+	}
+	if c.responded {
+		return errContinueAfterResponse
+	}
+	if _, err := c.buf.WriteString(c.proto + " 100 Continue\r\n\r\n"); err != nil {
+		return err
+	}
+	if err := c.buf.Flush(); err != nil {
+		return err
+	}
+	cr := newChunkedReader(c.buf.Reader)
+	cr.trailer = c.trailer
+	c.cr = cr
+	return nil
+}
@@ -0,0 +1,895 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A header-only REQMOD request, as sent for URL filtering.
+const reqmodNoBody = "REQMOD icap://icap-server.net/server?arg=87 ICAP/1.0\r\n" +
+	"Host: icap-server.net\r\n" +
+	"Encapsulated: req-hdr=0, null-body=174\r\n" +
+	"\r\n" +
+	"GET /origin-resource/index.html HTTP/1.1\r\n" +
+	"Host: www.origin-server.com\r\n" +
+	"Accept: text/html, text/plain\r\n" +
+	"Accept-Encoding: compress\r\n" +
+	"Cache-Control: no-cache\r\n" +
+	"User-Agent: test\r\n" +
+	"\r\n"
+
+func newTestReadWriter(s string) *bufio.ReadWriter {
+	return bufio.NewReadWriter(bufio.NewReader(strings.NewReader(s)), bufio.NewWriter(ioutil.Discard))
+}
+
+func TestReadRequestNoBody(t *testing.T) {
+	req, err := ReadRequest(newTestReadWriter(reqmodNoBody))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	checkString("Method", req.Method, "REQMOD", t)
+	checkString("HTTP URL", req.Request.URL.String(), "/origin-resource/index.html", t)
+	checkString("HTTP Host", req.Request.Host, "www.origin-server.com", t)
+	checkString("User-Agent", req.Request.Header.Get("User-Agent"), "test", t)
+
+	body, err := ioutil.ReadAll(req.Request.Body)
+	if err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	checkString("Body", string(body), "", t)
+}
+
+func BenchmarkReadRequestNoBody(b *testing.B) {
+	b.ReportAllocs()
+	r := strings.NewReader(reqmodNoBody)
+	br := bufio.NewReader(r)
+	rw := bufio.NewReadWriter(br, bufio.NewWriter(ioutil.Discard))
+	for i := 0; i < b.N; i++ {
+		r.Reset(reqmodNoBody)
+		br.Reset(r)
+		if _, err := ReadRequest(rw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEncapsulatedOrder(t *testing.T) {
+	httpReq := "GET /origin-resource HTTP/1.1\r\n" +
+		"Host: www.origin-server.com\r\n" +
+		"\r\n"
+	httpResp := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n"
+	request := "RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: res-body=107, res-hdr=62, req-hdr=0\r\n" +
+		"\r\n" +
+		httpReq + httpResp +
+		"5\r\n" +
+		"hello\r\n" +
+		"0\r\n" +
+		"\r\n"
+
+	req, err := ReadRequest(newTestReadWriter(request))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	checkString("HTTP URL", req.Request.URL.String(), "/origin-resource", t)
+	checkString("Content-Type", req.Response.Header.Get("Content-Type"), "text/plain", t)
+
+	body, err := ioutil.ReadAll(req.Response.Body)
+	if err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	checkString("Body", string(body), "hello", t)
+}
+
+func TestEncapsulatedBodyNotLast(t *testing.T) {
+	_, err := parseEncapsulated(nil, "req-hdr=0, req-body=50, res-hdr=100")
+	if err == nil {
+		t.Fatal("no error for body section that is not last")
+	}
+}
+
+func TestReadRequestPeekedPreview(t *testing.T) {
+	httpReq := "POST /origin-resource HTTP/1.1\r\n" +
+		"Host: www.origin-server.com\r\n" +
+		"\r\n"
+	request := "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Preview: 5\r\n" +
+		"Encapsulated: req-hdr=0, req-body=63\r\n" +
+		"\r\n" +
+		httpReq +
+		"5\r\n" +
+		"hello\r\n" +
+		"0\r\n" +
+		"\r\n" +
+		"6\r\n" +
+		" world\r\n" +
+		"0\r\n" +
+		"\r\n"
+
+	// Sniff the start of the stream, as a multi-protocol listener would.
+	br := bufio.NewReader(strings.NewReader(request))
+	if p, err := br.Peek(6); err != nil || string(p) != "REQMOD" {
+		t.Fatalf("Peek returned %q, %v", p, err)
+	}
+	rw := bufio.NewReadWriter(br, bufio.NewWriter(ioutil.Discard))
+
+	req, err := ReadRequest(rw)
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	checkString("Preview", string(req.Preview), "hello", t)
+
+	body, err := ioutil.ReadAll(req.Request.Body)
+	if err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	checkString("Body", string(body), "hello world", t)
+}
+
+func TestConnectionClose(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		close bool
+	}{
+		{"close", true},
+		{"Close", true},
+		{"keep-alive, CLOSE", true},
+		{"Keep-Alive", false},
+		{"closed", false},
+	} {
+		request := "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Connection: " + c.value + "\r\n" +
+			"\r\n"
+		req, err := ReadRequest(newTestReadWriter(request))
+		if err != nil {
+			t.Fatalf("error reading request: %v", err)
+		}
+		if req.Close != c.close {
+			t.Errorf("Close is %v for Connection: %s (should be %v)", req.Close, c.value, c.close)
+		}
+	}
+}
+
+// previewRequest returns a REQMOD request whose body begins with preview.
+func previewRequest(preview string) string {
+	return "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Preview: 5\r\n" +
+		"Encapsulated: req-hdr=0, req-body=63\r\n" +
+		"\r\n" +
+		"POST /origin-resource HTTP/1.1\r\n" +
+		"Host: www.origin-server.com\r\n" +
+		"\r\n" +
+		preview
+}
+
+func TestPreviewIEOF(t *testing.T) {
+	request := previewRequest("5; name=value\r\n" +
+		"hello\r\n" +
+		"0; ieof\r\n" +
+		"\r\n")
+	out := new(strings.Builder)
+	rw := bufio.NewReadWriter(bufio.NewReader(strings.NewReader(request)), bufio.NewWriter(out))
+
+	req, err := ReadRequest(rw)
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	checkString("Preview", string(req.Preview), "hello", t)
+	checkString("PreviewExtension", req.PreviewExtension, "ieof", t)
+	if !req.PreviewEOF || !req.PreviewIsEOF() {
+		t.Error("PreviewEOF is false (should be true)")
+	}
+
+	body, err := ioutil.ReadAll(req.Request.Body)
+	if err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	checkString("Body", string(body), "hello", t)
+	rw.Flush()
+	checkString("Written", out.String(), "", t)
+}
+
+func TestReadRequestLargePreview(t *testing.T) {
+	// Without a Server, MaxPreviewBytes does not apply.
+	size := DefaultMaxPreviewBytes + 1
+	request := strings.Replace(previewRequest(fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", size, strings.Repeat("x", size))),
+		"Preview: 5", "Preview: "+strconv.Itoa(size), 1)
+	req, err := ReadRequest(newTestReadWriter(request))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	if len(req.Preview) != size {
+		t.Errorf("Preview is %d bytes (should be %d)", len(req.Preview), size)
+	}
+}
+
+func TestPreviewContinue(t *testing.T) {
+	request := previewRequest("5\r\n" +
+		"hello\r\n" +
+		"0; x-note=\"more\"\r\n" +
+		"\r\n" +
+		"6; name=value\r\n" +
+		" world\r\n" +
+		"0\r\n" +
+		"\r\n")
+	out := new(strings.Builder)
+	rw := bufio.NewReadWriter(bufio.NewReader(strings.NewReader(request)), bufio.NewWriter(out))
+
+	req, err := ReadRequest(rw)
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	checkString("Preview", string(req.Preview), "hello", t)
+	checkString("PreviewExtension", req.PreviewExtension, "x-note=\"more\"", t)
+	if req.PreviewEOF || req.PreviewIsEOF() {
+		t.Error("PreviewEOF is true (should be false)")
+	}
+	checkString("Written", out.String(), "", t)
+
+	body, err := ioutil.ReadAll(req.Request.Body)
+	if err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	checkString("Body", string(body), "hello world", t)
+	checkString("Written", out.String(), "ICAP/1.0 100 Continue\r\n\r\n", t)
+}
+
+func TestPreviewSize(t *testing.T) {
+	req, err := ReadRequest(newTestReadWriter(reqmodNoBody))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	if req.PreviewSize != -1 {
+		t.Errorf("PreviewSize is %d without a Preview header (should be -1)", req.PreviewSize)
+	}
+
+	// An empty preview, followed by the whole body.
+	request := strings.Replace(previewRequest("0\r\n"+
+		"\r\n"+
+		"5\r\n"+
+		"hello\r\n"+
+		"0\r\n"+
+		"\r\n"), "Preview: 5", "Preview: 0", 1)
+	out := new(strings.Builder)
+	rw := bufio.NewReadWriter(bufio.NewReader(strings.NewReader(request)), bufio.NewWriter(out))
+	req, err = ReadRequest(rw)
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	if req.PreviewSize != 0 || len(req.Preview) != 0 || req.PreviewEOF {
+		t.Errorf("PreviewSize %d, Preview %q, PreviewEOF %v (should be 0, empty, false)", req.PreviewSize, req.Preview, req.PreviewEOF)
+	}
+	body, err := ioutil.ReadAll(req.Request.Body)
+	if err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	checkString("Body", string(body), "hello", t)
+	checkString("Written", out.String(), "ICAP/1.0 100 Continue\r\n\r\n", t)
+
+	// A preview that holds the whole body.
+	req, err = ReadRequest(newTestReadWriter(previewRequest("5\r\nhello\r\n0; ieof\r\n\r\n")))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	if req.PreviewSize != 5 || !req.PreviewEOF {
+		t.Errorf("PreviewSize %d, PreviewEOF %v (should be 5, true)", req.PreviewSize, req.PreviewEOF)
+	}
+
+	// More preview data than the header allows.
+	_, err = ReadRequest(newTestReadWriter(previewRequest("6\r\nhello!\r\n0\r\n\r\n")))
+	if err == nil {
+		t.Error("no error for preview longer than Preview header")
+	}
+}
+
+func TestBodyType(t *testing.T) {
+	req, err := ReadRequest(newTestReadWriter(reqmodNoBody))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	if req.BodyType() != NullBody {
+		t.Errorf("BodyType is %v (should be NullBody)", req.BodyType())
+	}
+
+	req, err = ReadRequest(newTestReadWriter(previewRequest("5\r\nhello\r\n0; ieof\r\n\r\n")))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	if req.BodyType() != ReqBody {
+		t.Errorf("BodyType is %v (should be ReqBody)", req.BodyType())
+	}
+	if req.Body() != req.Request.Body {
+		t.Error("Body is not the HTTP request body")
+	}
+}
+
+func TestBodyAlignment(t *testing.T) {
+	// After a null-body request, nothing should be left unread.
+	rw := newTestReadWriter(reqmodNoBody)
+	if _, err := ReadRequest(rw); err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	if rest, _ := ioutil.ReadAll(rw); len(rest) != 0 {
+		t.Errorf("%q left unread after null-body request", rest)
+	}
+
+	// A body offset that points past the start of the body is rejected.
+	request := strings.Replace(previewRequest("5\r\nhello\r\n0\r\n\r\n"), "req-body=63", "req-body=62", 1)
+	if _, err := ReadRequest(newTestReadWriter(request)); err == nil {
+		t.Error("no error for misaligned body offset")
+	}
+}
+
+func TestRequestWriteTo(t *testing.T) {
+	for _, request := range []string{
+		"REQMOD icap://icap-server.net/server?arg=87 ICAP/1.0\r\n" +
+			"Encapsulated: req-hdr=0, req-body=63\r\n" +
+			"Host: icap-server.net\r\n" +
+			"\r\n" +
+			"POST /origin-resource HTTP/1.1\r\n" +
+			"Host: www.origin-server.com\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"\r\n",
+		"RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Encapsulated: req-hdr=0, res-hdr=62, res-body=107\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Preview: 5\r\n" +
+			"\r\n" +
+			"GET /origin-resource HTTP/1.1\r\n" +
+			"Host: www.origin-server.com\r\n" +
+			"\r\n" +
+			"HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"0; ieof\r\n" +
+			"\r\n",
+		"OPTIONS icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"\r\n",
+		"REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Encapsulated: req-hdr=0, req-body=63\r\n" +
+			"Host: icap-server.net\r\n" +
+			"\r\n" +
+			"POST /origin-resource HTTP/1.1\r\n" +
+			"Host: www.origin-server.com\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc\r\n" +
+			"\r\n",
+		"RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Encapsulated: res-hdr=0, res-body=45\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Preview: 5\r\n" +
+			"\r\n" +
+			"HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"0; ieof\r\n" +
+			"X-Checksum: abc\r\n" +
+			"\r\n",
+	} {
+		req, err := ReadRequest(newTestReadWriter(request))
+		if err != nil {
+			t.Fatalf("error reading request: %v", err)
+		}
+		out := new(strings.Builder)
+		n, err := req.WriteTo(out)
+		if err != nil {
+			t.Fatalf("error writing request: %v", err)
+		}
+		checkString("Request", out.String(), request, t)
+		if n != int64(len(request)) {
+			t.Errorf("WriteTo returned %d (should be %d)", n, len(request))
+		}
+	}
+}
+
+func TestReadTrailer(t *testing.T) {
+	request := "RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: res-hdr=0, res-body=45\r\n" +
+		"\r\n" +
+		"HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"5\r\n" +
+		"hello\r\n" +
+		"0\r\n" +
+		"X-Checksum: abc\r\n" +
+		"x-signature:  def \r\n" +
+		"\r\n"
+	req, err := ReadRequest(newTestReadWriter(request))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	body, err := ioutil.ReadAll(req.Response.Body)
+	if err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	checkString("Body", string(body), "hello", t)
+	checkString("X-Checksum trailer", req.Response.Trailer.Get("X-Checksum"), "abc", t)
+	checkString("X-Signature trailer", req.Response.Trailer.Get("X-Signature"), "def", t)
+
+	// Without a trailer, Trailer is left nil.
+	req, err = ReadRequest(newTestReadWriter(strings.Replace(request, "X-Checksum: abc\r\nx-signature:  def \r\n", "", 1)))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	if _, err := ioutil.ReadAll(req.Response.Body); err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	if req.Response.Trailer != nil {
+		t.Errorf("Trailer is %v for a body with no trailer (should be nil)", req.Response.Trailer)
+	}
+}
+
+func TestRESPMODBodyFraming(t *testing.T) {
+	// The ICAP chunking delimits the body, whatever the embedded
+	// response's own length headers say.
+	for _, framing := range []string{
+		"",
+		"Content-Length: 3\r\n",
+		"Content-Length: 100\r\n",
+		"Transfer-Encoding: chunked\r\n",
+		"Connection: close\r\n",
+	} {
+		httpResp := "HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			framing +
+			"\r\n"
+		request := "RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpResp)) + "\r\n" +
+			"\r\n" +
+			httpResp +
+			"5\r\n" +
+			"hello\r\n" +
+			"6\r\n" +
+			" world\r\n" +
+			"0\r\n" +
+			"\r\n"
+
+		req, err := ReadRequest(newTestReadWriter(request))
+		if err != nil {
+			t.Fatalf("error reading request with %q: %v", framing, err)
+		}
+		body, err := ioutil.ReadAll(req.Response.Body)
+		if err != nil {
+			t.Fatalf("error reading body with %q: %v", framing, err)
+		}
+		checkString("Body with "+framing, string(body), "hello world", t)
+	}
+}
+
+func TestEncapsulatedTooManyEntries(t *testing.T) {
+	s := "req-hdr=0"
+	for i := 1; i < maxEncapsulatedEntries-1; i++ {
+		s += ", req-hdr=" + strconv.Itoa(i*10)
+	}
+	s += ", null-body=1000"
+	if _, err := parseEncapsulated(nil, s); err != nil {
+		t.Errorf("error for %d entries: %v", maxEncapsulatedEntries, err)
+	}
+	s = "req-hdr=0, " + s
+	if _, err := parseEncapsulated(nil, s); err == nil {
+		t.Errorf("no error for %d entries", maxEncapsulatedEntries+1)
+	}
+}
+
+func TestEncapsulatedOffsetsIncrease(t *testing.T) {
+	for _, s := range []string{
+		"req-hdr=0, res-hdr=0, res-body=40",
+		"req-hdr=0, res-hdr=40, res-body=40",
+		"res-hdr=0, null-body=0",
+	} {
+		if _, err := parseEncapsulated(nil, s); err == nil {
+			t.Errorf("no error for %q", s)
+		}
+	}
+
+	// Sections listed out of order are still read by offset.
+	sections, err := parseEncapsulated(nil, "res-hdr=40, req-hdr=0, res-body=100")
+	if err != nil {
+		t.Fatalf("error for sections out of order: %v", err)
+	}
+	if sections[0].key != "req-hdr" || sections[1].key != "res-hdr" {
+		t.Errorf("sections out of order read as %v", sections)
+	}
+}
+
+func TestEncapsulatedBodyOffsetMismatch(t *testing.T) {
+	// The HTTP header is 63 bytes long.
+	for _, offset := range []int{40, 62, 64, 70} {
+		request := "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: req-hdr=0, req-body=" + strconv.Itoa(offset) + "\r\n" +
+			"\r\n" +
+			"POST /origin-resource HTTP/1.1\r\n" +
+			"Host: www.origin-server.com\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"\r\n"
+		_, err := ReadRequest(newTestReadWriter(request))
+		if err == nil || !strings.Contains(err.Error(), "req-body offset does not match the end of req-hdr") {
+			t.Errorf("error for req-body=%d is %v", offset, err)
+		}
+	}
+}
+
+func TestPreviewBodyBoundary(t *testing.T) {
+	request := previewRequest("5\r\n" +
+		"hello\r\n" +
+		"0\r\n" +
+		"\r\n" +
+		"3\r\n" +
+		", w\r\n" +
+		"4\r\n" +
+		"orld\r\n" +
+		"0\r\n" +
+		"\r\n")
+
+	for _, size := range []int{1, 3, 5, 6, 64} {
+		req, err := ReadRequest(newTestReadWriter(request))
+		if err != nil {
+			t.Fatalf("error reading request: %v", err)
+		}
+
+		// Read the body in pieces of size bytes, so that reads
+		// straddle the end of the preview in different places.
+		var body []byte
+		buf := make([]byte, size)
+		for {
+			n, err := req.Request.Body.Read(buf)
+			body = append(body, buf[:n]...)
+			if err != nil {
+				break
+			}
+		}
+		checkString("Body read in pieces of "+strconv.Itoa(size), string(body), "hello, world", t)
+		checkString("Preview after reading body", string(req.Preview), "hello", t)
+	}
+}
+
+func TestAllow204(t *testing.T) {
+	for _, c := range []struct {
+		allow []string
+		want  bool
+	}{
+		{nil, false},
+		{[]string{"204"}, true},
+		{[]string{"trailers, 204"}, true},
+		{[]string{"trailers", "204"}, true},
+		{[]string{"2045"}, false},
+		{[]string{"trailers"}, false},
+	} {
+		req := &Request{Header: textproto.MIMEHeader{"Allow": c.allow}}
+		if got := req.Allow204(); got != c.want {
+			t.Errorf("Allow204 with Allow %q is %v (should be %v)", c.allow, got, c.want)
+		}
+	}
+}
+
+func TestServiceArgs(t *testing.T) {
+	req, err := ReadRequest(newTestReadWriter("RESPMOD icap://icap-server.net/scan?mode=strict&skip=exe&skip=zip&bad=%zz&arg=87 ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"\r\n"))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	args := req.ServiceArgs()
+	checkString("mode", args.Get("mode"), "strict", t)
+	checkString("arg", args.Get("arg"), "87", t)
+	if skip := args["skip"]; len(skip) != 2 || skip[0] != "exe" || skip[1] != "zip" {
+		t.Errorf("skip is %q (should be [exe zip])", skip)
+	}
+	if _, ok := args["bad"]; ok {
+		t.Errorf("malformed argument parsed as %q", args["bad"])
+	}
+	args.Set("cached", "yes")
+	checkString("cached", req.ServiceArgs().Get("cached"), "yes", t)
+
+	if args := new(Request).ServiceArgs(); args == nil || len(args) != 0 {
+		t.Errorf("ServiceArgs with no URL is %v (should be empty)", args)
+	}
+}
+
+func TestRawHeaders(t *testing.T) {
+	reqHdr := "GET /origin-resource HTTP/1.1\r\n" +
+		"host: www.origin-server.com\r\n" +
+		"X-custom:  spaced\r\n" +
+		"\r\n"
+	respHdr := "HTTP/1.1 200 OK\r\n" +
+		"content-type: text/plain\r\n" +
+		"\r\n"
+	request := "RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: req-hdr=0, res-hdr=" + strconv.Itoa(len(reqHdr)) + ", null-body=" + strconv.Itoa(len(reqHdr)+len(respHdr)) + "\r\n" +
+		"\r\n" +
+		reqHdr +
+		respHdr
+	req, err := ReadRequest(newTestReadWriter(request))
+	if err != nil {
+		t.Fatalf("error while reading request: %v", err)
+	}
+	checkString("RawReqHdr", string(req.RawReqHdr), reqHdr, t)
+	checkString("RawRespHdr", string(req.RawRespHdr), respHdr, t)
+	checkString("Parsed header", req.Request.Header.Get("X-Custom"), "spaced", t)
+
+	req, err = ReadRequest(newTestReadWriter(reqmodNoBody))
+	if err != nil {
+		t.Fatalf("error while reading request: %v", err)
+	}
+	if req.RawRespHdr != nil {
+		t.Errorf("RawRespHdr is %q for a request without res-hdr", req.RawRespHdr)
+	}
+}
+
+func TestRequestWriteToPreview(t *testing.T) {
+	head := "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Encapsulated: req-hdr=0, req-body=63\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Preview: 5\r\n" +
+		"\r\n" +
+		"POST /origin-resource HTTP/1.1\r\n" +
+		"Host: www.origin-server.com\r\n" +
+		"\r\n"
+	preview := "5\r\nhello\r\n0\r\n\r\n"
+	rest := "6\r\n world\r\n0\r\n\r\n"
+
+	client := new(strings.Builder)
+	rw := bufio.NewReadWriter(bufio.NewReader(strings.NewReader(head+preview+rest)), bufio.NewWriter(client))
+	req, err := ReadRequest(rw)
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+
+	// WriteTo stops after the preview, without asking the client for more.
+	out := new(strings.Builder)
+	if _, err := req.WriteTo(out); err != nil {
+		t.Fatalf("error writing request: %v", err)
+	}
+	checkString("Request", out.String(), head+preview, t)
+	checkString("Written to client", client.String(), "", t)
+
+	// WriteRest asks the client for the rest, and passes it on.
+	out.Reset()
+	n, err := req.WriteRest(out)
+	if err != nil {
+		t.Fatalf("error writing rest of body: %v", err)
+	}
+	checkString("Rest", out.String(), rest, t)
+	if n != int64(len(rest)) {
+		t.Errorf("WriteRest returned %d (should be %d)", n, len(rest))
+	}
+	checkString("Written to client", client.String(), "ICAP/1.0 100 Continue\r\n\r\n", t)
+
+	// A request made by NewRequest gets a preview from its body.
+	for _, c := range []struct {
+		body, preview, rest string
+	}{
+		{"hello world", "5\r\nhello\r\n0\r\n\r\n", " world"},
+		{"hello", "5\r\nhello\r\n0; ieof\r\n\r\n", ""},
+		{"hi", "2\r\nhi\r\n0; ieof\r\n\r\n", ""},
+	} {
+		httpReq, _ := http.NewRequest("POST", "http://www.origin-server.com/origin-resource", strings.NewReader(c.body))
+		req, err := NewRequest("REQMOD", "icap://icap-server.net/server", httpReq, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Preview", "5")
+		out.Reset()
+		if _, err := req.WriteTo(out); err != nil {
+			t.Fatalf("error writing request: %v", err)
+		}
+		if !strings.HasSuffix(out.String(), "\r\n\r\n"+c.preview) {
+			t.Errorf("Request with body %q is %q (should end with preview %q)", c.body, out.String(), c.preview)
+		}
+		out.Reset()
+		_, err = req.WriteRest(out)
+		if c.rest == "" {
+			if err == nil {
+				t.Errorf("WriteRest with body %q: no error after the whole body", c.body)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("error writing rest of body: %v", err)
+		}
+		body, err := ioutil.ReadAll(newChunkedReader(bufio.NewReader(strings.NewReader(out.String()))))
+		if err != nil {
+			t.Fatalf("error decoding rest of body %q: %v", out.String(), err)
+		}
+		checkString("Rest", string(body), c.rest, t)
+	}
+}
+
+func TestRequestWriteToEditedHeader(t *testing.T) {
+	request := "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Encapsulated: req-hdr=0, null-body=62\r\n" +
+		"Host: icap-server.net\r\n" +
+		"\r\n" +
+		"GET /origin-resource HTTP/1.1\r\n" +
+		"Host: www.origin-server.com\r\n" +
+		"\r\n"
+	req, err := ReadRequest(newTestReadWriter(request))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	req.Header.Add("Via", "1.0 relay.example.com")
+	req.Header.Set("X-Client-IP", "192.0.2.1")
+	req.Request.Header.Set("X-Scanned", "yes")
+
+	out := new(strings.Builder)
+	if _, err := req.WriteTo(out); err != nil {
+		t.Fatalf("error writing request: %v", err)
+	}
+	checkString("Request", out.String(), "REQMOD icap://icap-server.net/server ICAP/1.0\r\n"+
+		"Encapsulated: req-hdr=0, null-body=78\r\n"+
+		"Host: icap-server.net\r\n"+
+		"Via: 1.0 relay.example.com\r\n"+
+		"X-Client-Ip: 192.0.2.1\r\n"+
+		"\r\n"+
+		"GET /origin-resource HTTP/1.1\r\n"+
+		"Host: www.origin-server.com\r\n"+
+		"X-Scanned: yes\r\n"+
+		"\r\n", t)
+}
+
+func TestRESPMODHead(t *testing.T) {
+	request := "RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: req-hdr=0, res-hdr=63, null-body=129\r\n" +
+		"\r\n" +
+		"HEAD /origin-resource HTTP/1.1\r\n" +
+		"Host: www.origin-server.com\r\n" +
+		"\r\n" +
+		"HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Length: 100\r\n" +
+		"\r\n"
+	req, err := ReadRequest(newTestReadWriter(request))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	checkString("Response.Request.Method", req.Response.Request.Method, "HEAD", t)
+	if req.Response.ContentLength != 100 {
+		t.Errorf("ContentLength is %d (should be 100)", req.Response.ContentLength)
+	}
+	body, err := ioutil.ReadAll(req.Response.Body)
+	if err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	checkString("Body", string(body), "", t)
+}
+
+func TestNoBody(t *testing.T) {
+	req, err := ReadRequest(newTestReadWriter(reqmodNoBody))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	if req.Request.Body != http.NoBody || req.Request.ContentLength != 0 {
+		t.Errorf("Body is %T and ContentLength %d (should be http.NoBody and 0)", req.Request.Body, req.Request.ContentLength)
+	}
+	if _, err := httputil.DumpRequest(req.Request, true); err != nil {
+		t.Errorf("error dumping request: %v", err)
+	}
+
+	// In RESPMOD, the request's body is not encapsulated, even if its
+	// headers say it has one.
+	reqHdr := "POST /form HTTP/1.1\r\n" +
+		"Host: www.origin-server.com\r\n" +
+		"Content-Length: 11\r\n" +
+		"\r\n"
+	resHdr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n"
+	request := "RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: req-hdr=0, res-hdr=" + strconv.Itoa(len(reqHdr)) + ", res-body=" + strconv.Itoa(len(reqHdr+resHdr)) + "\r\n" +
+		"\r\n" +
+		reqHdr + resHdr +
+		"5\r\nhello\r\n0\r\n\r\n"
+	req, err = ReadRequest(newTestReadWriter(request))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	if req.Request.Body != http.NoBody || req.Request.ContentLength != 0 {
+		t.Errorf("Body is %T and ContentLength %d (should be http.NoBody and 0)", req.Request.Body, req.Request.ContentLength)
+	}
+	dump, err := httputil.DumpRequest(req.Request, true)
+	if err != nil {
+		t.Fatalf("error dumping request: %v", err)
+	}
+	if !strings.HasSuffix(string(dump), "\r\n\r\n") {
+		t.Errorf("dump is %q (should end with the headers)", dump)
+	}
+	body, err := ioutil.ReadAll(req.Response.Body)
+	if err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	checkString("Body", string(body), "hello", t)
+}
+
+func TestEncapsulatedWithoutBodySection(t *testing.T) {
+	request := "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: req-hdr=0\r\n" +
+		"\r\n" +
+		"GET /origin-resource HTTP/1.1\r\n" +
+		"Host: www.origin-server.com\r\n" +
+		"\r\n" +
+		"OPTIONS icap://icap-server.net/server ICAP/1.0\r\n" +
+		"\r\n"
+	rw := newTestReadWriter(request)
+	req, err := ReadRequest(rw)
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	if req.Request == nil {
+		t.Fatal("no HTTP request")
+	}
+	checkString("Host", req.Request.Host, "www.origin-server.com", t)
+	if req.BodyType() != NullBody {
+		t.Errorf("BodyType is %v (should be NullBody)", req.BodyType())
+	}
+
+	// The stream is left at the start of the next request.
+	next, err := ReadRequest(rw)
+	if err != nil {
+		t.Fatalf("error reading next request: %v", err)
+	}
+	checkString("Method", next.Method, "OPTIONS", t)
+}
+
+func TestParseRequestBytes(t *testing.T) {
+	request := previewRequest("5\r\n" +
+		"hello\r\n" +
+		"0\r\n" +
+		"\r\n" +
+		"6\r\n" +
+		" world\r\n" +
+		"0\r\n" +
+		"\r\n")
+	req, err := ParseRequestBytes([]byte(request))
+	if err != nil {
+		t.Fatalf("error parsing request: %v", err)
+	}
+	checkString("Preview", string(req.Preview), "hello", t)
+	body, err := ioutil.ReadAll(req.Request.Body)
+	if err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	checkString("Body", string(body), "hello world", t)
+
+	if _, err := ParseRequestBytes([]byte(request + "extra")); err == nil {
+		t.Error("no error for data after the request")
+	}
+}
@@ -7,22 +7,36 @@
 package icap
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"html"
 	"io"
-	"log"
+	"io/ioutil"
 	"net/http"
-	"net/http/httputil"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// A ResponseWriter is used by a Handler to answer a request. The
+// functions that write a complete response, such as Finish, Redirect
+// and WritePartial, do so through its methods, so a middleware (see
+// Chain) may pass the handler a wrapper that sees the whole response.
+// A wrapper should have a method Unwrap() ResponseWriter, returning the
+// ResponseWriter it wraps, so that functions that need the server's own
+// ResponseWriter, such as BufferBody and Continue, can find it.
 type ResponseWriter interface {
 	// Header returns the header map that will be sent by WriteHeader.
 	// Changing the header after a call to WriteHeader (or Write) has
 	// no effect.
+	//
+	// Keys are written exactly as they appear in the map. Header().Set
+	// canonicalizes the key ("X-Icap-Profile"); to send a vendor header
+	// with other casing, assign to the map directly:
+	//	w.Header()["X-ICAP-Profile"] = []string{"strict"}
 	Header() http.Header
 
 	// Write writes the data to the connection as part of an ICAP reply.
@@ -34,6 +48,34 @@ type ResponseWriter interface {
 	// Then it sends an HTTP header if httpMessage is not nil.
 	// httpMessage may be an *http.Request or an *http.Response.
 	// hasBody should be true if there will be calls to Write(), generating a message body.
+	//
+	// To send back the original HTTP message with its body unchanged,
+	// pass it with hasBody true and copy its body into the ResponseWriter:
+	//	w.WriteHeader(http.StatusOK, req.Request, true)
+	//	io.Copy(w, req.Request.Body)
+	// The rest of the body after a preview is then asked for before the
+	// header is sent. (WriteWithOriginalBody does the same.) Passing the
+	// original message with hasBody false drops its body, and is logged.
+	//
+	// The body is streamed, not buffered: each Write goes out as a chunk
+	// once the connection's write buffer fills (or on Flush; see
+	// Flusher), and the request body is read from the connection as the
+	// handler reads it. So a handler can adapt a body of any size a piece
+	// at a time, by passing an adapted header and copying through a
+	// filter:
+	//	Continue(w, req) // if req has a preview
+	//	w.WriteHeader(http.StatusOK, newResponse, true)
+	//	io.Copy(w, scanner(req.Response.Body))
+	// For a previewed request, Continue must be called before
+	// WriteHeader unless httpMessage is the original message: once the
+	// response header is written, "100 Continue" can't be sent, and
+	// reading past the preview returns an error. Only BufferBody and
+	// Server.StrictResponseValidation hold the whole response in memory.
+	//
+	// For a successful response, the ModifyRequest and
+	// SatisfyWithResponse functions say more plainly which kind of
+	// message is being sent; new code should prefer them to passing an
+	// HTTP message here.
 	WriteHeader(code int, httpMessage interface{}, hasBody bool)
 }
 
@@ -43,12 +85,83 @@ type respWriter struct {
 	header      http.Header    // the ICAP header to write for the response
 	wroteHeader bool           // true if the headers have already been written
 	cw          io.WriteCloser // the chunked writer used to write the body
+	trailer     *http.Header   // the Trailer of the HTTP message whose body is written to cw
+	status      int            // the status code of the response, once the header is written
+	bodyBytes   int64          // the body bytes passed to Write, before chunked encoding
+	err         error          // the first error writing the body, if any
+	rawHeader   []string       // fields from AddRawHeader, as "Key: value"
+	closeAfter  bool           // true if the connection is to be closed after this response
+
+	// For BufferBody, the arguments to WriteHeader are kept in held,
+	// and the body written to cw is kept in memory, until the handler
+	// returns. Then the header is written with Content-Length.
+	bufferBody bool
+	held       *heldHeader
+
+	// For Server.StrictResponseValidation, the response is written to
+	// recorded, through record, instead of to the connection.
+	record   *bufio.Writer
+	recorded *bytes.Buffer
+}
+
+// writer returns the buffered writer that the response is written to.
+func (w *respWriter) writer() *bufio.Writer {
+	if w.record != nil {
+		return w.record
+	}
+	return w.conn.buf.Writer
 }
 
 func (w *respWriter) Header() http.Header {
 	return w.header
 }
 
+// AddRawHeader adds a header field to the response being written by w,
+// written exactly as given, for clients that insist on particular
+// capitalization or ordering of extension headers. Raw fields follow
+// the fields from Header, in the order they were added, and are sent in
+// addition to them. A key or value containing CR or LF, or a key
+// containing a colon, is not allowed; such a field is logged and left
+// out. If w is not, and does not wrap, the ResponseWriter the server
+// passed to the handler, the field is left out too.
+func AddRawHeader(w ResponseWriter, key, value string) {
+	rw := serverWriter(w)
+	if rw == nil {
+		return
+	}
+	if key == "" || strings.ContainsAny(key, ":\r\n") || strings.ContainsAny(value, "\r\n") {
+		rw.conn.server.logf("icap: invalid raw header field %q: %q", key, value)
+		return
+	}
+	rw.rawHeader = append(rw.rawHeader, key+": "+value)
+}
+
+// serverLogf logs through the ErrorLog of the Server that w belongs to,
+// or the standard logger if that can't be found.
+func serverLogf(w ResponseWriter, format string, args ...interface{}) {
+	var srv *Server
+	if rw := serverWriter(w); rw != nil && rw.conn != nil {
+		srv = rw.conn.server
+	}
+	srv.logf(format, args...)
+}
+
+// serverWriter returns the ResponseWriter that the server created, which
+// w is or wraps, following the Unwrap methods of wrappers; or nil if
+// there is none.
+func serverWriter(w ResponseWriter) *respWriter {
+	for {
+		switch v := w.(type) {
+		case *respWriter:
+			return v
+		case interface{ Unwrap() ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
 func (w *respWriter) Write(p []byte) (n int, err error) {
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK, nil, true)
@@ -57,96 +170,608 @@ func (w *respWriter) Write(p []byte) (n int, err error) {
 	if w.cw == nil {
 		return 0, errors.New("called Write() on an icap.ResponseWriter that should not have a body")
 	}
-	return w.cw.Write(p)
+	if w.err != nil {
+		// The client has probably gone away; don't keep writing to it.
+		return 0, w.err
+	}
+	n, err = w.cw.Write(p)
+	w.bodyBytes += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
 }
 
 func (w *respWriter) WriteHeader(code int, httpMessage interface{}, hasBody bool) {
 	if w.wroteHeader {
-		log.Println("Called WriteHeader twice on the same connection")
+		w.conn.server.logf("icap: WriteHeader called twice on the same connection")
+		return
+	}
+	if code != http.StatusNoContent && originalWithBody(w.req, httpMessage) {
+		if !hasBody {
+			w.conn.server.logf("icap: WriteHeader for %s %s: the original HTTP message is sent with hasBody false, so its body is dropped", w.req.Method, w.req.RawURL)
+		} else if w.req.cont != nil {
+			// The handler will copy the original body, reading past the
+			// preview, and "100 Continue" can't be sent once the
+			// response has begun.
+			if err := w.req.cont.start(); err != nil {
+				w.err = err
+			}
+		}
+	}
+	if w.bufferBody && hasBody && code != http.StatusNoContent {
+		w.held = &heldHeader{code, httpMessage}
+		w.cw = new(heldBody)
+		w.wroteHeader = true
 		return
 	}
+	w.writeHeader(code, httpMessage, hasBody, -1)
+}
+
+// originalWithBody reports whether msg is the HTTP message encapsulated
+// in req that carried its body.
+func originalWithBody(req *Request, msg interface{}) bool {
+	switch m := msg.(type) {
+	case *http.Request:
+		return m == req.Request && req.bodySection == "req-body"
+	case *http.Response:
+		return m == req.Response && req.bodySection == "res-body"
+	}
+	return false
+}
+
+// writeHeader writes the response header, as WriteHeader does. If
+// contentLength is not negative, it is given as the Content-Length of
+// the HTTP message.
+func (w *respWriter) writeHeader(code int, httpMessage interface{}, hasBody bool, contentLength int) {
+	if w.req.cont != nil {
+		w.req.cont.responded = true
+	}
 
 	// Make the HTTP header and the Encapsulated: header.
-	var header []byte
-	var encap string
+	var reqHdr, respHdr []byte
 	var err error
+	bodyKey := "null-body"
+	if hasBody {
+		method := w.req.Method
+		if len(method) > 3 {
+			method = method[0:3]
+		}
+		bodyKey = strings.ToLower(method) + "-body"
+	}
 
 	switch msg := httpMessage.(type) {
 	case *http.Request:
-		header, err = httpRequestHeader(msg)
-		if err != nil {
-			break
+		reqHdr, err = httpRequestHeader(msg)
+		if err == nil && hasBody {
+			bodyKey = "req-body"
+			w.trailer = &msg.Trailer
 		}
-		if hasBody {
-			encap = fmt.Sprintf("req-hdr=0, req-body=%d", len(header))
-		} else {
-			encap = fmt.Sprintf("req-hdr=0, null-body=%d", len(header))
-		}
-
 	case *http.Response:
-		header, err = httpResponseHeader(msg)
-		if err != nil {
-			break
-		}
-		if hasBody {
-			encap = fmt.Sprintf("res-hdr=0, res-body=%d", len(header))
-		} else {
-			encap = fmt.Sprintf("res-hdr=0, null-body=%d", len(header))
+		respHdr, err = httpResponseHeader(msg)
+		if err == nil && hasBody {
+			bodyKey = "res-body"
+			w.trailer = &msg.Trailer
 		}
 	}
-
-	if encap == "" {
-		if hasBody {
-			method := w.req.Method
-			if len(method) > 3 {
-				method = method[0:3]
+	if err != nil {
+		reqHdr, respHdr = nil, nil
+	}
+	if contentLength >= 0 {
+		reqHdr = addContentLength(reqHdr, contentLength)
+		respHdr = addContentLength(respHdr, contentLength)
+	}
+	header := append(reqHdr, respHdr...)
+	encap := encapsulatedHeader(reqHdr, respHdr, bodyKey)
+
+	if code == http.StatusNoContent {
+		// A 204 response carries no encapsulated message, so the
+		// Encapsulated header is left out.
+		w.header.Del("Encapsulated")
+		header = nil
+		hasBody = false
+	} else {
+		w.header.Set("Encapsulated", encap)
+	}
+	if srv := w.conn.server; srv != nil {
+		if _, ok := w.header["Istag"]; !ok && srv.ISTag != "" {
+			w.header.Set("ISTag", srv.ISTag)
+		}
+		for k, v := range srv.DefaultResponseHeaders {
+			if _, ok := w.header[k]; !ok {
+				w.header[k] = append([]string(nil), v...)
 			}
-			method = strings.ToLower(method)
-			encap = fmt.Sprintf("%s-body=0", method)
-		} else {
-			encap = "null-body=0"
 		}
 	}
-
-	w.header.Set("Encapsulated", encap)
 	if _, ok := w.header["Date"]; !ok {
 		w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
 	}
 
-	w.header.Set("Connection", "close")
+	if !w.closeAfter && !w.conn.keepAlive(w.req, code) {
+		w.closeAfter = true
+	}
+	if w.closeAfter {
+		w.header.Set("Connection", "close")
+	} else {
+		w.header.Set("Connection", "keep-alive")
+	}
 
-	bw := w.conn.buf.Writer
+	// Assemble the whole header, so that it goes to the connection in a
+	// single write even if it is larger than the output buffer.
+	var hb bytes.Buffer
 	status := StatusText(code)
 	if status == "" {
 		status = fmt.Sprintf("status code %d", code)
 	}
-	fmt.Fprintf(bw, "ICAP/1.0 %d %s\r\n", code, status)
-	w.header.Write(bw)
-	io.WriteString(bw, "\r\n")
-
-	if header != nil {
-		bw.Write(header)
+	fmt.Fprintf(&hb, "%s %d %s\r\n", w.conn.server.proto(), code, status)
+	w.header.Write(&hb)
+	for _, f := range w.rawHeader {
+		hb.WriteString(f + "\r\n")
 	}
+	hb.WriteString("\r\n")
+	hb.Write(header)
+	w.writer().Write(hb.Bytes())
 
 	w.wroteHeader = true
+	w.status = code
 
 	if hasBody {
-		w.cw = httputil.NewChunkedWriter(w.conn.buf.Writer)
+		w.cw = &chunkedWriter{Wire: w.writer()}
+	}
+}
+
+// ModifyRequest answers a REQMOD request with req, the adapted HTTP
+// request, which the client should send on to the origin server.
+// It calls w.WriteHeader(http.StatusOK, req, hasBody).
+func ModifyRequest(w ResponseWriter, req *http.Request, hasBody bool) {
+	if req == nil {
+		w.WriteHeader(http.StatusOK, nil, hasBody)
+		return
 	}
+	w.WriteHeader(http.StatusOK, req, hasBody)
+}
+
+// SatisfyWithResponse answers a request with resp, an HTTP response to
+// give to the user. For REQMOD this satisfies the request, so it is not
+// sent to the origin server at all. It calls
+// w.WriteHeader(http.StatusOK, resp, hasBody).
+func SatisfyWithResponse(w ResponseWriter, resp *http.Response, hasBody bool) {
+	if resp == nil {
+		w.WriteHeader(http.StatusOK, nil, hasBody)
+		return
+	}
+	w.WriteHeader(http.StatusOK, resp, hasBody)
+}
+
+// Continue sends "100 Continue", asking the client for the rest of the
+// body of req after its preview. The handler can then read the body to
+// the end; reading past the preview also sends "100 Continue" if it has
+// not been sent already and the response header has not been written
+// (after that, the read returns an error). It is an error to call Continue after the
+// response header has been written, or for a request with no more body
+// to come: one without a Preview header, or whose preview ended with
+// ieof.
+func Continue(w ResponseWriter, req *Request) error {
+	if rw := serverWriter(w); rw != nil && rw.wroteHeader {
+		return errors.New("icap: Continue called after WriteHeader")
+	}
+	if req.cont == nil {
+		return errors.New("icap: Continue called for a request with no more body after the preview")
+	}
+	return req.cont.start()
+}
+
+// BufferBody, called before WriteHeader, holds the response being
+// written by w until the handler returns, keeping the body in memory,
+// so that the encapsulated HTTP message can be sent with a
+// Content-Length header giving the length of the body, for clients and
+// origin servers that expect one. (Otherwise Content-Length is left
+// out, since the body may have changed.) It has no effect on a response
+// without a body, or if w is not, and does not wrap, the ResponseWriter
+// the server passed to the handler. Flush sends nothing while the
+// response is held.
+func BufferBody(w ResponseWriter) {
+	if rw := serverWriter(w); rw != nil && !rw.wroteHeader {
+		rw.bufferBody = true
+	}
+}
+
+// A heldHeader holds the arguments to WriteHeader for BufferBody.
+type heldHeader struct {
+	code        int
+	httpMessage interface{}
+}
+
+// A heldBody keeps the body of a response in memory for BufferBody.
+type heldBody struct {
+	bytes.Buffer
+}
+
+func (b *heldBody) Close() error {
+	return nil
+}
+
+// writeHeld writes the response held for BufferBody, with the length
+// of its body as the Content-Length of the HTTP message.
+func (w *respWriter) writeHeld() {
+	h, body := w.held, w.cw.(*heldBody)
+	w.held, w.cw, w.wroteHeader = nil, nil, false
+
+	w.writeHeader(h.code, h.httpMessage, true, body.Len())
+	if body.Len() > 0 {
+		if _, err := w.cw.Write(body.Bytes()); err != nil {
+			w.err = err
+		}
+	}
+}
+
+// addContentLength adds a Content-Length field to hdr, a raw HTTP
+// header ending with a blank line, if it is not empty.
+func addContentLength(hdr []byte, n int) []byte {
+	if len(hdr) < 2 {
+		return hdr
+	}
+	hdr = append(hdr[:len(hdr)-2], "Content-Length: "...)
+	hdr = strconv.AppendInt(hdr, int64(n), 10)
+	return append(hdr, "\r\n\r\n"...)
+}
+
+// A Flusher is a ResponseWriter that can send the response data it has
+// buffered to the client. The ResponseWriter that the server passes to
+// handlers is one. Writes are buffered, and otherwise only sent when
+// the buffer fills or the handler returns; a handler producing output
+// incrementally may interleave calls to Write and Flush. If WriteHeader
+// has not yet been called, Flush calls WriteHeader(http.StatusOK, nil,
+// true).
+type Flusher interface {
+	Flush()
+}
+
+func (w *respWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK, nil, true)
+	}
+	if w.err == nil && w.held == nil {
+		w.err = w.writer().Flush()
+	}
+}
+
+// WriteRedirect answers req with an HTTP redirect to location, using
+// the HTTP status code code (such as http.StatusFound). The redirect is
+// sent as an encapsulated HTTP response, so for REQMOD it satisfies the
+// request instead of modifying it. A relative location is resolved
+// against the URL of the HTTP request. (Redirect, by contrast, answers
+// with an ICAP redirect.)
+func WriteRedirect(w ResponseWriter, req *Request, code int, location string) {
+	if req.Request != nil {
+		base := *req.Request.URL
+		if base.Host == "" {
+			base.Host = req.Request.Host
+		}
+		if base.Scheme == "" {
+			base.Scheme = "http"
+		}
+		if u, err := base.Parse(location); err == nil {
+			location = u.String()
+		}
+	}
+
+	resp := &http.Response{
+		StatusCode: code,
+		Proto:      "HTTP/1.1",
+		Header:     make(http.Header),
+	}
+	resp.Header.Set("Location", location)
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+	SatisfyWithResponse(w, resp, true)
+	fmt.Fprintf(w, "<a href=\"%s\">%s</a>.\n", html.EscapeString(location), http.StatusText(code))
+}
+
+// Finish sends the response that RFC 3507 calls for once the handler
+// has decided whether to change the message encapsulated in req:
+//
+//	modified  client allows 204  in preview  response
+//	no        yes                -           204 No Modifications
+//	no        no                 yes         204 No Modifications
+//	no        no                 no          the original message and body
+//	yes       -                  -           newMsg and the original body
+//
+// A request is in preview if it has a Preview header and the rest of
+// its body has not yet been asked for. newMsg may be an *http.Request,
+// an *http.Response, or an http.Header, as for WriteWithOriginalBody.
+// The body is streamed from req, so the handler must not have read
+// past the preview; to change the body, write the response directly.
+// If req encapsulates no HTTP message, as for OPTIONS, the unmodified
+// response carries none either. If copying the body fails, Finish returns the error, and the body is
+// left unterminated so that the client sees it is incomplete.
+func Finish(w ResponseWriter, req *Request, modified bool, newMsg interface{}) error {
+	if !modified {
+		inPreview := req.Header.Get("Preview") != "" && (req.cont == nil || req.cont.cr == nil)
+		if req.Allow204() || inPreview {
+			w.WriteHeader(http.StatusNoContent, nil, false)
+			return nil
+		}
+		// Assigning a nil pointer would make newMsg a non-nil interface.
+		newMsg = nil
+		switch {
+		case req.Method == "RESPMOD" && req.Response != nil:
+			newMsg = req.Response
+		case req.Request != nil:
+			newMsg = req.Request
+		}
+	}
+	err := WriteWithOriginalBody(w, req, newMsg)
+	if err != nil {
+		abortBody(w, err)
+	}
+	return err
+}
+
+// Forward tells the client that the message encapsulated in req, which
+// is normally the request being answered or a copy of it made by
+// WithContext, needs no changes. It calls Finish(w, req, false, nil):
+// it sends 204 No Modifications if the client allows it (see
+// Request.Allow204) or the request is still in preview, and otherwise
+// sends back the original HTTP request (for REQMOD) or response (for
+// RESPMOD), with its body copied through as it is read, so the handler
+// should not have read any of the body itself. For a request with no
+// encapsulated message, such as OPTIONS, the 200 has none either.
+func Forward(w ResponseWriter, req *Request) error {
+	return Finish(w, req, false, nil)
+}
+
+// abortBody records err as the error writing the body of the response
+// being written by w, so that the body is left unterminated.
+func abortBody(w ResponseWriter, err error) {
+	if rw := serverWriter(w); rw != nil && rw.err == nil {
+		rw.err = err
+	}
+}
+
+// Status returns the status code of the response, or 0 if none has been
+// written yet. It reflects every way of answering, such as Finish or
+// Redirect. A response held by BufferBody counts as written. If the
+// server replaces the response with an error after the handler returns
+// (see Server.StrictResponseValidation), Status reports the error.
+func (w *respWriter) Status() int {
+	if w.status == 0 && w.held != nil {
+		return w.held.code
+	}
+	return w.status
+}
+
+// BytesWritten returns the number of bytes of the encapsulated body
+// passed to Write so far, including those copied from the original body
+// by methods such as Finish. It counts the body's own bytes, not the
+// chunked encoding that carries them.
+func (w *respWriter) BytesWritten() int64 {
+	return w.bodyBytes
+}
+
+// WritePartial answers req with its original HTTP message, and its
+// body changed by putting replacement at offset. If keepOriginalLength
+// is true, replacement overwrites as many bytes of the original body;
+// otherwise it is inserted.
+//
+// If the client allows it (see Request.Allow206), the response is 206
+// Partial Content: only the body up to the end of replacement is sent,
+// and the last chunk has a use-original-body extension telling the
+// client where to continue with its copy of the original body.
+// Otherwise, or if w is not, and does not wrap, the ResponseWriter the
+// server passed to the handler, or if BufferBody is holding the
+// response, it is a 200 with the whole modified body.
+//
+// The original body is read from req, so the handler must not have read
+// its first offset bytes (or for a 200, any of it), except as the
+// preview. If it has, WritePartial returns an error, and the body is
+// left unterminated, so that the client sees the response is incomplete.
+func WritePartial(w ResponseWriter, req *Request, offset int, replacement []byte, keepOriginalLength bool) error {
+	rw := serverWriter(w)
+	if rw != nil && rw.wroteHeader {
+		return errors.New("icap: WritePartial called after WriteHeader")
+	}
+	resume := offset // where the rest of the original body starts
+	if keepOriginalLength {
+		resume += len(replacement)
+	}
+	partial := req.Allow206() && rw != nil && !rw.bufferBody
+
+	// Ask for the rest of the body now if it will be needed, so that
+	// "100 Continue" is not sent in the middle of the response.
+	if req.cont != nil && (!partial || offset > len(req.Preview)) {
+		if err := req.cont.start(); err != nil {
+			abortBody(w, err)
+			return err
+		}
+	}
+
+	code := http.StatusOK
+	var msg interface{}
+	switch {
+	case req.Method == "RESPMOD" && req.Response != nil:
+		msg = req.Response
+	case req.Request != nil:
+		msg = req.Request
+	}
+	if partial {
+		// Pass a copy, so that WriteHeader doesn't take the response to
+		// be the whole original body, and ask for the rest of it.
+		code = http.StatusPartialContent
+		switch m := msg.(type) {
+		case *http.Request:
+			r := *m
+			msg = &r
+		case *http.Response:
+			r := *m
+			msg = &r
+		}
+	}
+	w.WriteHeader(code, msg, true)
+
+	body := req.Body()
+	if _, err := io.CopyN(w, body, int64(offset)); err != nil {
+		err = noEOF(err)
+		abortBody(w, err)
+		return err
+	}
+	if _, err := w.Write(replacement); err != nil {
+		return err
+	}
+	if partial {
+		if cw, ok := rw.cw.(*chunkedWriter); ok {
+			cw.lastExt = "use-original-body=" + strconv.Itoa(resume)
+		}
+		return nil
+	}
+	if _, err := io.CopyN(ioutil.Discard, body, int64(resume-offset)); err != nil {
+		err = noEOF(err)
+		abortBody(w, err)
+		return err
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		abortBody(w, err)
+		return err
+	}
+	return nil
+}
+
+// noEOF returns err, but io.ErrUnexpectedEOF instead of io.EOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// WriteWithOriginalBody sends msg as the adapted HTTP message, with the
+// body of the message encapsulated in req streamed through unchanged.
+// msg may be an *http.Request or an *http.Response; or it may be an
+// http.Header, which replaces the header of the original HTTP message
+// (the request for REQMOD, the response for RESPMOD).
+func WriteWithOriginalBody(w ResponseWriter, req *Request, msg interface{}) error {
+	if h, ok := msg.(http.Header); ok {
+		switch {
+		case req.Method == "RESPMOD" && req.Response != nil:
+			resp := *req.Response
+			resp.Header = h
+			msg = &resp
+		case req.Request != nil:
+			r := *req.Request
+			r.Header = h
+			msg = &r
+		default:
+			return errors.New("icap: WriteWithOriginalBody: no HTTP message to take the header from")
+		}
+	}
+
+	hasBody := req.BodyType() == ReqBody || req.BodyType() == ResBody
+	if hasBody && req.cont != nil {
+		// Ask for the rest of the body now; "100 Continue" can't be
+		// sent once the response has begun.
+		if err := req.cont.start(); err != nil {
+			return err
+		}
+	}
+	w.WriteHeader(http.StatusOK, msg, hasBody)
+	if !hasBody {
+		return nil
+	}
+	_, err := CopyBody(context.Background(), w, req.Body(), 0, nil)
+	return err
 }
 
 func (w *respWriter) finishRequest() {
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK, nil, false)
 	}
+	if w.held != nil {
+		w.writeHeld()
+	}
 
 	if w.cw != nil {
-		w.cw.Close()
+		// The trailer is read along with the body, so it is only
+		// complete now.
+		cw, chunked := w.cw.(*chunkedWriter)
+		if chunked && w.trailer != nil {
+			cw.trailer = *w.trailer
+		}
+		if w.err == nil {
+			if chunked {
+				w.err = cw.finish()
+			} else {
+				w.err = w.cw.Close()
+			}
+		}
 		w.cw = nil
-		io.WriteString(w.conn.buf, "\r\n")
 	}
 
-	w.conn.buf.Flush()
+	if w.err == nil {
+		w.err = w.writer().Flush()
+	}
+
+	if w.recorded != nil {
+		if !w.conn.sendValidated(w.req, w.recorded.Bytes()) {
+			w.closeAfter = true
+			w.status = http.StatusInternalServerError
+		}
+		w.recorded, w.record = nil, nil
+	}
+}
+
+// A Section is one part of an encapsulated message, for BuildEncapsulated:
+// a header section (req-hdr or res-hdr) and its length in bytes, or a body
+// section (req-body, res-body, opt-body, or null-body).
+type Section struct {
+	Name   string
+	Length int
+}
+
+// BuildEncapsulated returns the value of the Encapsulated header for a
+// message made up of sections in order, such as
+//
+//	req-hdr=0, res-hdr=137, res-body=296
+//
+// Each offset is the total length of the sections before it. The message
+// must end with a body section; if the last of sections is not one,
+// null-body is added. The lengths of body sections are ignored.
+func BuildEncapsulated(sections []Section) string {
+	var b strings.Builder
+	offset := 0
+	last := ""
+	for i, sec := range sections {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s=%d", sec.Name, offset)
+		offset += sec.Length
+		last = sec.Name
+	}
+	switch last {
+	case "req-body", "res-body", "opt-body", "null-body":
+	default:
+		if len(sections) > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "null-body=%d", offset)
+	}
+	return b.String()
+}
+
+// encapsulatedHeader returns the value of the Encapsulated header for a
+// message made up of the given HTTP headers (either may be nil) followed
+// by the body section named bodyKey: req-body, res-body, opt-body, or null-body.
+func encapsulatedHeader(reqHdr, respHdr []byte, bodyKey string) string {
+	var buf [3]Section
+	sections := buf[:0]
+	if reqHdr != nil {
+		sections = append(sections, Section{"req-hdr", len(reqHdr)})
+	}
+	if respHdr != nil {
+		sections = append(sections, Section{"res-hdr", len(respHdr)})
+	}
+	return BuildEncapsulated(append(sections, Section{Name: bodyKey}))
 }
 
 // httpRequestHeader returns the headers for an HTTP request
@@ -169,10 +794,7 @@ func httpRequestHeader(req *http.Request) (hdr []byte, err error) {
 	uri := req.URL.String()
 
 	fmt.Fprintf(buf, "%s %s %s\r\n", valueOrDefault(req.Method, "GET"), uri, valueOrDefault(req.Proto, "HTTP/1.1"))
-	req.Header.WriteSubset(buf, map[string]bool{
-		"Transfer-Encoding": true,
-		"Content-Length":    true,
-	})
+	req.Header.WriteSubset(buf, hopHeaders(req.Header))
 	io.WriteString(buf, "\r\n")
 
 	return buf.Bytes(), nil
@@ -184,7 +806,17 @@ func httpResponseHeader(resp *http.Response) (hdr []byte, err error) {
 	buf := new(bytes.Buffer)
 
 	// Status line
+	// resp.Status may be "200 OK" or just "OK". If it starts with a
+	// different code, StatusCode has been changed (to turn a page into a
+	// block page, say), and the text no longer applies.
 	text := resp.Status
+	if len(text) >= 4 && text[3] == ' ' && isDigits(text[:3]) {
+		if text[:3] == strconv.Itoa(resp.StatusCode) {
+			text = text[4:]
+		} else {
+			text = ""
+		}
+	}
 	if text == "" {
 		text = http.StatusText(resp.StatusCode)
 		if text == "" {
@@ -196,15 +828,85 @@ func httpResponseHeader(resp *http.Response) (hdr []byte, err error) {
 		proto = "HTTP/1.1"
 	}
 	fmt.Fprintf(buf, "%s %d %s\r\n", proto, resp.StatusCode, text)
-	resp.Header.WriteSubset(buf, map[string]bool{
-		"Transfer-Encoding": true,
-		"Content-Length":    true,
-	})
+	resp.Header.WriteSubset(buf, hopHeaders(resp.Header))
 	io.WriteString(buf, "\r\n")
 
 	return buf.Bytes(), nil
 }
 
+// isDigits reports whether s is made up of ASCII digits.
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// hopHeaders returns the set of headers in h that should not be
+// copied into an encapsulated message: the framing headers, the
+// hop-by-hop headers of RFC 2616 section 13.5.1 (Connection itself
+// among them), and any others named in the Connection header.
+func hopHeaders(h http.Header) map[string]bool {
+	exclude := map[string]bool{
+		"Transfer-Encoding":   true,
+		"Content-Length":      true,
+		"Connection":          true,
+		"Proxy-Connection":    true,
+		"Keep-Alive":          true,
+		"Proxy-Authenticate":  true,
+		"Proxy-Authorization": true,
+		"Te":                  true,
+		"Upgrade":             true,
+	}
+	for _, v := range h["Connection"] {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				exclude[http.CanonicalHeaderKey(t)] = true
+			}
+		}
+	}
+	return exclude
+}
+
+// AddWarning adds a Warning header to h, such as
+//
+//	Warning: 214 icap.example.com "Transformation Applied"
+//
+// to tell downstream systems that adaptation was partial or degraded.
+// h may be the ICAP header from ResponseWriter.Header, or the header of
+// the adapted HTTP message; code is a warn-code such as 199 (miscellaneous
+// warning) or 214 (transformation applied), and agent names the service.
+// text is sent as a quoted-string; control characters in it are left out.
+func AddWarning(h http.Header, code int, agent, text string) {
+	if agent == "" {
+		agent = "-"
+	}
+	h.Add("Warning", fmt.Sprintf("%03d %s %s", code, agent, quoteString(text)))
+}
+
+// quoteString returns s as an HTTP quoted-string (RFC 7230, section
+// 3.2.6): double quotes and backslashes are escaped with a backslash,
+// and control characters other than tab, which a quoted-string cannot
+// hold, are dropped. Bytes above 0x7F are passed through as obs-text.
+func quoteString(s string) string {
+	b := make([]byte, 0, len(s)+2)
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < ' ' && c != '\t' || c == 0x7f:
+			// dropped
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(append(b, '"'))
+}
+
 // Return value if nonempty, def otherwise.
 func valueOrDefault(value, def string) string {
 	if value != "" {
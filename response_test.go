@@ -5,13 +5,50 @@
 package icap
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-const serverAddr = "localhost:11344"
+// roundTrip starts a server with handler on a free local port, sends
+// request to it, and returns everything the server writes back.
+func roundTrip(request string, handler Handler, t *testing.T) string {
+	return serverRoundTrip(&Server{Handler: handler}, request, t)
+}
+
+// serverRoundTrip is like roundTrip, but runs srv instead of a default Server.
+func serverRoundTrip(srv *Server, request string, t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer conn.Close()
+
+	// Closing the write side lets the server see that no more requests
+	// are coming, so it closes the connection after the response.
+	io.WriteString(conn, request)
+	conn.(*net.TCPConn).CloseWrite()
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("error while reading response: %v", err)
+	}
+	return string(response)
+}
 
 // REQMOD example 2 from RFC 3507, adjusted for order of headers, etc.
 func TestREQMOD2(t *testing.T) {
@@ -32,7 +69,7 @@ func TestREQMOD2(t *testing.T) {
 			"\r\n"
 	resp :=
 		"ICAP/1.0 200 OK\r\n" +
-			"Connection: close\r\n" +
+			"Connection: keep-alive\r\n" +
 			"Date: Mon, 10 Jan 2000  09:55:21 GMT\r\n" +
 			"Encapsulated: req-hdr=0, req-body=231\r\n" +
 			"Istag: \"W3E4R7U9-L2E4-2\"\r\n" +
@@ -51,22 +88,8 @@ func TestREQMOD2(t *testing.T) {
 			"\r\n"
 
 	HandleFunc("/server", HandleREQMOD2)
-	go ListenAndServe(serverAddr, nil)
-
-	conn, err := net.Dial("tcp", serverAddr)
-	if err != nil {
-		t.Fatalf("could not connect to ICAP server on localhost")
-	}
 
-	io.WriteString(conn, request)
-	respBuffer := make([]byte, len(resp))
-	_, err = io.ReadFull(conn, respBuffer)
-
-	if err != nil {
-		t.Fatalf("error while reading response: %v", err)
-	}
-
-	response := string(respBuffer)
+	response := roundTrip(request, nil, t)
 	checkString("Response", response, resp, t)
 }
 
@@ -85,3 +108,937 @@ func HandleREQMOD2(w ResponseWriter, req *Request) {
 	w.WriteHeader(200, req.Request, true)
 	io.WriteString(w, newBody)
 }
+
+func TestNoContentWithISTag(t *testing.T) {
+	request :=
+		"REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: req-hdr=0, null-body=51\r\n" +
+			"\r\n" +
+			"GET /index.html HTTP/1.1\r\n" +
+			"Host: www.example.com\r\n" +
+			"\r\n"
+	resp :=
+		"ICAP/1.0 204 No Modifications\r\n" +
+			"Connection: keep-alive\r\n" +
+			"Date: Mon, 10 Jan 2000  09:55:21 GMT\r\n" +
+			"Istag: \"W3E4R7U9-L2E4-2\"\r\n" +
+			"Service: ICAP-Server-Software/1.0\r\n" +
+			"\r\n"
+
+	response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.Header().Set("Date", "Mon, 10 Jan 2000  09:55:21 GMT")
+		w.Header().Set("ISTag", "\"W3E4R7U9-L2E4-2\"")
+		w.Header().Set("Service", "ICAP-Server-Software/1.0")
+		w.WriteHeader(204, nil, false)
+	}), t)
+	checkString("Response", response, resp, t)
+}
+
+func TestServerProto(t *testing.T) {
+	request :=
+		"OPTIONS icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"\r\n"
+	srv := &Server{
+		Proto: "ICAP/1.1",
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.Header().Set("Date", "Mon, 10 Jan 2000  09:55:21 GMT")
+			w.WriteHeader(200, nil, false)
+		}),
+	}
+	resp :=
+		"ICAP/1.1 200 OK\r\n" +
+			"Connection: keep-alive\r\n" +
+			"Date: Mon, 10 Jan 2000  09:55:21 GMT\r\n" +
+			"Encapsulated: null-body=0\r\n" +
+			"\r\n"
+
+	response := serverRoundTrip(srv, request, t)
+	checkString("Response", response, resp, t)
+
+	// "100 Continue" uses the same version.
+	srv.Handler = HandlerFunc(func(w ResponseWriter, req *Request) {
+		Continue(w, req)
+		w.WriteHeader(204, nil, false)
+	})
+	response = serverRoundTrip(srv, previewRequest("5\r\nhello\r\n0\r\n\r\n0\r\n\r\n"), t)
+	if !strings.HasPrefix(response, "ICAP/1.1 100 Continue\r\n\r\nICAP/1.1 204 No Modifications\r\n") {
+		t.Errorf("Response is %q (should be ICAP/1.1 100 Continue, then 204)", response)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	request :=
+		"REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: req-hdr=0, null-body=51\r\n" +
+			"\r\n" +
+			"GET /index.html HTTP/1.1\r\n" +
+			"Host: www.example.com\r\n" +
+			"\r\n"
+
+	response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+		WriteRedirect(w, req, http.StatusFound, "/moved.html")
+	}), t)
+
+	if !strings.HasPrefix(response, "ICAP/1.0 200 OK\r\n") {
+		t.Fatalf("Response is %s (should be ICAP 200)", response)
+	}
+	if !strings.Contains(response, "Encapsulated: res-hdr=0, res-body=") {
+		t.Fatalf("Response is %s (should encapsulate an HTTP response)", response)
+	}
+	if !strings.Contains(response, "\r\n\r\nHTTP/1.1 302 Found\r\n") {
+		t.Fatalf("Response is %s (should contain an HTTP 302)", response)
+	}
+	if !strings.Contains(response, "Location: http://www.example.com/moved.html\r\n") {
+		t.Fatalf("Response is %s (should contain an absolute Location)", response)
+	}
+}
+
+func TestHopHeadersStripped(t *testing.T) {
+	h := make(http.Header)
+	h.Set("Connection", "keep-alive, X-Hop")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("X-Hop", "1")
+	h.Set("Proxy-Authenticate", "Basic")
+	h.Set("Content-Type", "text/plain")
+	hdr, err := httpResponseHeader(&http.Response{StatusCode: 200, Header: h})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp :=
+		"HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n"
+	checkString("HTTP header", string(hdr), resp, t)
+
+	h = make(http.Header)
+	h.Set("Proxy-Connection", "keep-alive")
+	h.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	h.Set("Te", "trailers")
+	h.Set("Accept", "text/html")
+	hdr, err = httpRequestHeader(&http.Request{Method: "GET", URL: &url.URL{Path: "/"}, Host: "www.example.com", Header: h})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req :=
+		"GET / HTTP/1.1\r\n" +
+			"Accept: text/html\r\n" +
+			"Host: www.example.com\r\n" +
+			"\r\n"
+	checkString("HTTP header", string(hdr), req, t)
+}
+
+func TestClientClosesMidResponse(t *testing.T) {
+	request :=
+		"REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: req-hdr=0, null-body=51\r\n" +
+			"\r\n" +
+			"GET /index.html HTTP/1.1\r\n" +
+			"Host: www.example.com\r\n" +
+			"\r\n"
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+
+	writeErr := make(chan error, 1)
+	go Serve(l, HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.WriteHeader(200, &http.Response{StatusCode: 200, Header: make(http.Header)}, true)
+		chunk := make([]byte, 64*1024)
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+	}))
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	io.WriteString(conn, request)
+	if _, err := io.ReadFull(conn, make([]byte, 1024)); err != nil {
+		t.Fatalf("error while reading response: %v", err)
+	}
+	conn.Close()
+
+	select {
+	case <-writeErr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write did not return an error after the client closed the connection")
+	}
+}
+
+func TestResponseLineEndings(t *testing.T) {
+	request :=
+		"REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: req-hdr=0, null-body=51\r\n" +
+			"\r\n" +
+			"GET /index.html HTTP/1.1\r\n" +
+			"Host: www.example.com\r\n" +
+			"\r\n"
+
+	response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+		// A newline in a header value must not end the line early.
+		w.Header().Set("X-Note", "one\ntwo")
+		req.Request.Header.Set("X-Note", "three\nfour")
+		w.WriteHeader(200, req.Request, true)
+		io.WriteString(w, "first chunk")
+		io.WriteString(w, "second chunk")
+	}), t)
+
+	if !strings.HasSuffix(response, "\r\n0\r\n\r\n") {
+		t.Fatalf("Response is %q (should end with a 0-length chunk and a blank line)", response)
+	}
+	for i := 0; i < len(response); i++ {
+		if response[i] == '\n' && (i == 0 || response[i-1] != '\r') {
+			t.Fatalf("Response is %q (bare LF at offset %d)", response, i)
+		}
+	}
+}
+
+func TestWriteWithOriginalBody(t *testing.T) {
+	request :=
+		"RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: res-hdr=0, res-body=62\r\n" +
+			"\r\n" +
+			"HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"Set-Cookie: a=b\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"\r\n"
+	resp :=
+		"ICAP/1.0 200 OK\r\n" +
+			"Connection: keep-alive\r\n" +
+			"Date: Mon, 10 Jan 2000  09:55:21 GMT\r\n" +
+			"Encapsulated: res-hdr=0, res-body=45\r\n" +
+			"\r\n" +
+			"HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"\r\n"
+
+	response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.Header().Set("Date", "Mon, 10 Jan 2000  09:55:21 GMT")
+		h := make(http.Header)
+		h.Set("Content-Type", req.Response.Header.Get("Content-Type"))
+		if err := WriteWithOriginalBody(w, req, h); err != nil {
+			t.Error(err)
+		}
+	}), t)
+	checkString("Response", response, resp, t)
+}
+
+func TestWriteTrailer(t *testing.T) {
+	request :=
+		"RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: res-hdr=0, res-body=45\r\n" +
+			"\r\n" +
+			"HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc\r\n" +
+			"\r\n"
+	resp :=
+		"ICAP/1.0 200 OK\r\n" +
+			"Connection: keep-alive\r\n" +
+			"Date: Mon, 10 Jan 2000  09:55:21 GMT\r\n" +
+			"Encapsulated: res-hdr=0, res-body=45\r\n" +
+			"\r\n" +
+			"HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc\r\n" +
+			"\r\n"
+
+	response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.Header().Set("Date", "Mon, 10 Jan 2000  09:55:21 GMT")
+		w.WriteHeader(200, req.Response, true)
+		io.Copy(w, req.Response.Body)
+	}), t)
+	checkString("Response", response, resp, t)
+}
+
+func TestNewChunkedWriter(t *testing.T) {
+	// Close writes only the last chunk; the caller ends the message.
+	var b strings.Builder
+	cw := NewChunkedWriter(&b)
+	io.WriteString(cw, "hello")
+	cw.Close()
+	checkString("Chunked body", b.String(), "5\r\nhello\r\n0\r\n", t)
+}
+
+func TestStreamingBody(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	go Serve(l, HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.WriteHeader(200, req.Response, true)
+		io.Copy(w, req.Response.Body)
+	}))
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The first part of the body is echoed before the client sends the
+	// rest, so the server cannot be waiting for the whole body.
+	const chunkSize = 64 << 10
+	chunk := fmt.Sprintf("%x\r\n%s\r\n", chunkSize, strings.Repeat("a", chunkSize))
+	io.WriteString(conn, "RESPMOD icap://icap-server.net/server ICAP/1.0\r\n"+
+		"Host: icap-server.net\r\n"+
+		"Encapsulated: res-hdr=0, res-body=45\r\n"+
+		"\r\n"+
+		"HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"\r\n"+
+		chunk)
+	received := 0
+	buf := make([]byte, 4096)
+	for received < chunkSize {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("error reading the start of the response after %d bytes: %v", received, err)
+		}
+		received += n
+	}
+
+	io.WriteString(conn, chunk+"0\r\n\r\n")
+	conn.(*net.TCPConn).CloseWrite()
+	rest, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("error reading the rest of the response: %v", err)
+	}
+	if !strings.HasSuffix(string(rest), "0\r\n\r\n") {
+		t.Errorf("response does not end with the last chunk")
+	}
+	if total := received + len(rest); total < 2*chunkSize {
+		t.Errorf("response is %d bytes (should hold the %d-byte body)", total, 2*chunkSize)
+	}
+}
+
+func TestAddWarning(t *testing.T) {
+	request :=
+		"RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: res-hdr=0, null-body=45\r\n" +
+			"\r\n" +
+			"HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n"
+	resp :=
+		"ICAP/1.0 200 OK\r\n" +
+			"Connection: keep-alive\r\n" +
+			"Date: Mon, 10 Jan 2000  09:55:21 GMT\r\n" +
+			"Encapsulated: res-hdr=0, null-body=92\r\n" +
+			"Warning: 199 scanner \"encrypted archive not scanned\"\r\n" +
+			"\r\n" +
+			"HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"Warning: 214 scanner \"Transformation Applied\"\r\n" +
+			"\r\n"
+
+	response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.Header().Set("Date", "Mon, 10 Jan 2000  09:55:21 GMT")
+		AddWarning(w.Header(), 199, "scanner", "encrypted archive not scanned")
+		AddWarning(req.Response.Header, 214, "scanner", "Transformation Applied")
+		w.WriteHeader(200, req.Response, false)
+	}), t)
+	checkString("Response", response, resp, t)
+
+	h := make(http.Header)
+	AddWarning(h, 199, "", "caf\u00e9 \"quoted\" back\\slash\x00\r\nEvil: yes\ttab")
+	checkString("Warning", h.Get("Warning"), "199 - \"caf\u00e9 \\\"quoted\\\" back\\\\slashEvil: yes\ttab\"", t)
+}
+
+func TestHeaderCasing(t *testing.T) {
+	request :=
+		"OPTIONS icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"\r\n"
+	resp :=
+		"ICAP/1.0 200 OK\r\n" +
+			"Connection: keep-alive\r\n" +
+			"Date: Mon, 10 Jan 2000  09:55:21 GMT\r\n" +
+			"Encapsulated: null-body=0\r\n" +
+			"X-ICAP-Profile: strict\r\n" +
+			"\r\n"
+
+	response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.Header().Set("Date", "Mon, 10 Jan 2000  09:55:21 GMT")
+		w.Header()["X-ICAP-Profile"] = []string{"strict"}
+		w.WriteHeader(200, nil, false)
+	}), t)
+	checkString("Response", response, resp, t)
+}
+
+func TestAddRawHeader(t *testing.T) {
+	request :=
+		"OPTIONS icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"\r\n"
+	resp :=
+		"ICAP/1.0 200 OK\r\n" +
+			"Connection: keep-alive\r\n" +
+			"Date: Mon, 10 Jan 2000  09:55:21 GMT\r\n" +
+			"Encapsulated: null-body=0\r\n" +
+			"X-VENDOR-B: 2\r\n" +
+			"x-vendor-a: 1\r\n" +
+			"\r\n"
+
+	response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.Header().Set("Date", "Mon, 10 Jan 2000  09:55:21 GMT")
+		AddRawHeader(w, "X-VENDOR-B", "2")
+		AddRawHeader(w, "x-vendor-a", "1")
+		AddRawHeader(w, "X-Injected", "1\r\nEvil: yes")
+		w.WriteHeader(200, nil, false)
+	}), t)
+	checkString("Response", response, resp, t)
+}
+
+func TestFlush(t *testing.T) {
+	request :=
+		"REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: req-hdr=0, null-body=51\r\n" +
+			"\r\n" +
+			"GET /index.html HTTP/1.1\r\n" +
+			"Host: www.example.com\r\n" +
+			"\r\n"
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+
+	// The handler doesn't finish until the client has seen the first chunk.
+	received := make(chan bool)
+	go Serve(l, HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.WriteHeader(200, &http.Response{StatusCode: 200, Header: make(http.Header)}, true)
+		io.WriteString(w, "first")
+		w.(Flusher).Flush()
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+		}
+		io.WriteString(w, "second")
+	}))
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer conn.Close()
+	io.WriteString(conn, request)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var response []byte
+	buf := make([]byte, 1024)
+	for !strings.Contains(string(response), "5\r\nfirst\r\n") {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("first chunk not received before handler returned: %v", err)
+		}
+		response = append(response, buf[:n]...)
+	}
+	close(received)
+}
+
+func TestBuildEncapsulated(t *testing.T) {
+	for _, c := range []struct {
+		sections []Section
+		want     string
+	}{
+		{nil, "null-body=0"},
+		{[]Section{{"req-hdr", 137}}, "req-hdr=0, null-body=137"},
+		{[]Section{{"req-hdr", 137}, {"req-body", 0}}, "req-hdr=0, req-body=137"},
+		{[]Section{{"req-hdr", 137}, {"res-hdr", 159}, {"res-body", 1000}}, "req-hdr=0, res-hdr=137, res-body=296"},
+		{[]Section{{Name: "opt-body"}}, "opt-body=0"},
+	} {
+		checkString("BuildEncapsulated", BuildEncapsulated(c.sections), c.want, t)
+	}
+}
+
+func TestFinish(t *testing.T) {
+	const httpReq = "POST /origin-resource HTTP/1.1\r\n" +
+		"Host: www.origin-server.com\r\n" +
+		"\r\n"
+	for _, c := range []struct {
+		allow204 bool
+		preview  bool
+		modified bool
+		readBody bool   // whether the handler reads past the preview first
+		status   string // the expected status line
+		body     string // the expected encapsulated body, if any
+	}{
+		{allow204: true, status: "ICAP/1.0 204 No Modifications"},
+		{status: "ICAP/1.0 200 OK", body: "5\r\nhello\r\n6\r\n world\r\n"},
+		{allow204: true, preview: true, status: "ICAP/1.0 204 No Modifications"},
+		{preview: true, status: "ICAP/1.0 204 No Modifications"},
+		{preview: true, readBody: true, status: "ICAP/1.0 200 OK"},
+		{modified: true, status: "ICAP/1.0 200 OK", body: "5\r\nhello\r\n6\r\n world\r\n"},
+		{allow204: true, modified: true, status: "ICAP/1.0 200 OK", body: "5\r\nhello\r\n6\r\n world\r\n"},
+		{preview: true, modified: true, status: "ICAP/1.0 200 OK", body: "5\r\nhello\r\n6\r\n world\r\n"},
+	} {
+		request := "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n"
+		if c.allow204 {
+			request += "Allow: 204\r\n"
+		}
+		if c.preview {
+			request += "Preview: 5\r\n"
+		}
+		request += "Encapsulated: req-hdr=0, req-body=63\r\n" +
+			"\r\n" +
+			httpReq +
+			"5\r\n" +
+			"hello\r\n"
+		if c.preview {
+			request += "0\r\n\r\n"
+		}
+		request += "6\r\n" +
+			" world\r\n" +
+			"0\r\n" +
+			"\r\n"
+
+		desc := fmt.Sprintf("Finish(allow204=%v, preview=%v, modified=%v, readBody=%v)", c.allow204, c.preview, c.modified, c.readBody)
+		response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+			if c.readBody {
+				ioutil.ReadAll(req.Body())
+			}
+			h := http.Header{"X-Modified": {"yes"}}
+			Finish(w, req, c.modified, h)
+		}), t)
+
+		if c.preview && (c.readBody || c.modified) {
+			if !strings.HasPrefix(response, "ICAP/1.0 100 Continue\r\n\r\n") {
+				t.Errorf("%s: response is %q (should start with 100 Continue)", desc, response)
+				continue
+			}
+			response = strings.TrimPrefix(response, "ICAP/1.0 100 Continue\r\n\r\n")
+		}
+		if !strings.HasPrefix(response, c.status+"\r\n") {
+			t.Errorf("%s: response is %q (should be %s)", desc, response, c.status)
+			continue
+		}
+		if c.modified != strings.Contains(response, "\r\nX-Modified: yes\r\n") {
+			t.Errorf("%s: response is %q (X-Modified should be present only if modified)", desc, response)
+		}
+		if c.body != "" && !strings.HasSuffix(response, "\r\n\r\n"+c.body+"0\r\n\r\n") {
+			t.Errorf("%s: response is %q (should end with body %q)", desc, response, c.body)
+		}
+	}
+}
+
+func TestForwardAllow204(t *testing.T) {
+	for _, allow := range []string{"", "Allow: 204\r\n"} {
+		request := "RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			allow +
+			"Encapsulated: res-hdr=0, res-body=45\r\n" +
+			"\r\n" +
+			"HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"\r\n"
+		response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+			Forward(w, req)
+		}), t)
+		if allow != "" {
+			if !strings.HasPrefix(response, "ICAP/1.0 204 No Modifications\r\n") {
+				t.Errorf("Response with %q is %s (should be a 204)", allow, response)
+			}
+			continue
+		}
+		if !strings.HasPrefix(response, "ICAP/1.0 200 OK\r\n") ||
+			!strings.Contains(response, "\r\n\r\nHTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n") ||
+			!strings.HasSuffix(response, "5\r\nhello\r\n0\r\n\r\n") {
+			t.Errorf("Response without Allow: 204 is %s (should echo the original response)", response)
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	for _, request := range []string{
+		"REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: req-hdr=0, req-body=63\r\n" +
+			"\r\n" +
+			"POST /origin-resource HTTP/1.1\r\n" +
+			"Host: www.origin-server.com\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"\r\n",
+		"REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: req-hdr=0, null-body=62\r\n" +
+			"\r\n" +
+			"GET /origin-resource HTTP/1.1\r\n" +
+			"Host: www.origin-server.com\r\n" +
+			"\r\n",
+		"RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: req-hdr=0, res-hdr=62, res-body=107\r\n" +
+			"\r\n" +
+			"GET /origin-resource HTTP/1.1\r\n" +
+			"Host: www.origin-server.com\r\n" +
+			"\r\n" +
+			"HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"3\r\n" +
+			"hel\r\n" +
+			"2\r\n" +
+			"lo\r\n" +
+			"0\r\n" +
+			"\r\n",
+		"OPTIONS icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"\r\n",
+	} {
+		handler := HandlerFunc(func(w ResponseWriter, req *Request) {
+			Forward(w, req)
+		})
+
+		response := roundTrip(strings.Replace(request, "Host: icap-server.net\r\n", "Host: icap-server.net\r\nAllow: 204\r\n", 1), handler, t)
+		if !strings.HasPrefix(response, "ICAP/1.0 204 No Modifications\r\n") {
+			t.Errorf("Response with Allow: 204 is %s (should be a 204)", response)
+		}
+
+		// Without Allow: 204, the encapsulated message comes back as it
+		// was sent; for RESPMOD, that is just the response, and for
+		// OPTIONS, nothing.
+		response = roundTrip(request, handler, t)
+		if !strings.HasPrefix(response, "ICAP/1.0 200 OK\r\n") {
+			t.Errorf("Response is %s (should be a 200)", response)
+			continue
+		}
+		sent := request[strings.Index(request, "\r\n\r\n")+4:]
+		if strings.HasPrefix(request, "RESPMOD") {
+			sent = sent[62:]
+		}
+		checkString("Encapsulated message", response[strings.Index(response, "\r\n\r\n")+4:], sent, t)
+	}
+}
+
+func TestWritePartial(t *testing.T) {
+	const resHdr = "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n"
+	for _, c := range []struct {
+		allow, preview string
+		offset         int
+		replacement    string
+		keep           bool
+		status, body   string
+	}{
+		{"Allow: 204, 206\r\n", "", 6, "WORLD", true,
+			"ICAP/1.0 206 Partial Content", "6\r\nhello \r\n5\r\nWORLD\r\n0; use-original-body=11\r\n\r\n"},
+		{"Allow: 204, 206\r\n", "", 6, "big ", false,
+			"ICAP/1.0 206 Partial Content", "6\r\nhello \r\n4\r\nbig \r\n0; use-original-body=6\r\n\r\n"},
+		{"Allow: 204\r\n", "", 6, "WORLD", true,
+			"ICAP/1.0 200 OK", "6\r\nhello \r\n5\r\nWORLD\r\n0\r\n\r\n"},
+		{"", "", 6, "big ", false,
+			"ICAP/1.0 200 OK", "6\r\nhello \r\n4\r\nbig \r\n5\r\nworld\r\n0\r\n\r\n"},
+		// Within the preview, the rest of the body is not needed.
+		{"Allow: 206\r\n", "Preview: 5\r\n", 2, "LL", true,
+			"ICAP/1.0 206 Partial Content", "2\r\nhe\r\n2\r\nLL\r\n0; use-original-body=4\r\n\r\n"},
+	} {
+		request := "RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			c.allow + c.preview +
+			"Encapsulated: res-hdr=0, res-body=45\r\n" +
+			"\r\n" +
+			resHdr
+		if c.preview != "" {
+			request += "5\r\nhello\r\n0\r\n\r\n"
+		} else {
+			request += "b\r\nhello world\r\n0\r\n\r\n"
+		}
+		response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+			WritePartial(w, req, c.offset, []byte(c.replacement), c.keep)
+		}), t)
+		desc := fmt.Sprintf("WritePartial(%d, %q, %v) with %q", c.offset, c.replacement, c.keep, c.allow+c.preview)
+		if !strings.HasPrefix(response, c.status+"\r\n") ||
+			!strings.HasSuffix(response, "\r\n\r\n"+resHdr+c.body) {
+			t.Errorf("%s: response is %q (should be %s with body %q)", desc, response, c.status, c.body)
+			continue
+		}
+		if err := ValidateResponse(strings.NewReader(response)); err != nil {
+			t.Errorf("%s: invalid response: %v", desc, err)
+		}
+	}
+
+	// With no encapsulated headers at all, the 200 carries just the body.
+	response := roundTrip("RESPMOD icap://icap-server.net/server ICAP/1.0\r\n"+
+		"Host: icap-server.net\r\n"+
+		"Encapsulated: res-body=0\r\n"+
+		"\r\n"+
+		"b\r\nhello world\r\n0\r\n\r\n", HandlerFunc(func(w ResponseWriter, req *Request) {
+		WritePartial(w, req, 6, []byte("WORLD"), true)
+	}), t)
+	if !strings.HasPrefix(response, "ICAP/1.0 200 OK\r\n") ||
+		!strings.Contains(response, "Encapsulated: res-body=0\r\n") ||
+		!strings.HasSuffix(response, "\r\n\r\n6\r\nhello \r\n5\r\nWORLD\r\n0\r\n\r\n") {
+		t.Errorf("Response with no encapsulated headers is %q (should be a 200 with the modified body)", response)
+	}
+}
+
+func TestWriteHeaderOriginalBody(t *testing.T) {
+	request := "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Preview: 5\r\n" +
+		"Encapsulated: req-hdr=0, req-body=63\r\n" +
+		"\r\n" +
+		"POST /origin-resource HTTP/1.1\r\n" +
+		"Host: www.origin-server.com\r\n" +
+		"\r\n" +
+		"5\r\n" +
+		"hello\r\n" +
+		"0\r\n" +
+		"\r\n" +
+		"6\r\n" +
+		" world\r\n" +
+		"0\r\n" +
+		"\r\n"
+
+	// Copying the body with io.Copy gets the rest of it after the
+	// preview, with "100 Continue" before the response.
+	response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.WriteHeader(200, req.Request, true)
+		io.Copy(w, req.Request.Body)
+	}), t)
+	if !strings.HasPrefix(response, "ICAP/1.0 100 Continue\r\n\r\nICAP/1.0 200 OK\r\n") ||
+		strings.Count(response, "100 Continue") != 1 ||
+		!strings.HasSuffix(response, "\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n") {
+		t.Errorf("Response is %q (should be 100 Continue, then the original request and body)", response)
+	}
+
+	// Leaving the body out is logged.
+	logged := make(chanWriter, 10)
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(200, req.Request, false)
+		}),
+		ErrorLog: log.New(logged, "", 0),
+	}
+	serverRoundTrip(srv, request, t)
+	select {
+	case msg := <-logged:
+		if !strings.Contains(msg, "body is dropped") {
+			t.Errorf("dropped body logged as %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("dropped body was not logged")
+	}
+}
+
+func TestReadAfterWriteHeader(t *testing.T) {
+	// Once a response with a different message has begun, reading past
+	// the preview fails rather than sending "100 Continue" into it.
+	var mu sync.Mutex
+	var readErr error
+	response := roundTrip(previewRequest("5\r\nhello\r\n0\r\n\r\n"), HandlerFunc(func(w ResponseWriter, req *Request) {
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+		}
+		w.WriteHeader(200, resp, true)
+		_, err := ioutil.ReadAll(req.Request.Body)
+		mu.Lock()
+		readErr = err
+		mu.Unlock()
+		io.WriteString(w, "blocked")
+	}), t)
+	mu.Lock()
+	defer mu.Unlock()
+	if readErr == nil {
+		t.Error("no error from reading past the preview after WriteHeader")
+	}
+	if strings.Contains(response, "100 Continue") {
+		t.Errorf("Response is %q (should not contain 100 Continue)", response)
+	}
+	if !strings.HasSuffix(response, "\r\n\r\n7\r\nblocked\r\n0\r\n\r\n") {
+		t.Errorf("Response is %q (should end with the new body)", response)
+	}
+}
+
+func TestModifyOrSatisfy(t *testing.T) {
+	request := "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: req-hdr=0, null-body=62\r\n" +
+		"\r\n" +
+		"GET /origin-resource HTTP/1.1\r\n" +
+		"Host: www.origin-server.com\r\n" +
+		"\r\n"
+
+	response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+		req.Request.Header.Set("X-Scanned", "yes")
+		ModifyRequest(w, req.Request, false)
+	}), t)
+	if !strings.Contains(response, "Encapsulated: req-hdr=0, null-body=") ||
+		!strings.Contains(response, "\r\n\r\nGET /origin-resource HTTP/1.1\r\n") ||
+		!strings.Contains(response, "\r\nX-Scanned: yes\r\n") {
+		t.Errorf("Response to ModifyRequest is %s (should be the modified request)", response)
+	}
+
+	response = roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+		resp := &http.Response{
+			StatusCode: http.StatusForbidden,
+			Proto:      "HTTP/1.1",
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+		}
+		SatisfyWithResponse(w, resp, true)
+		io.WriteString(w, "blocked")
+	}), t)
+	if !strings.Contains(response, "Encapsulated: res-hdr=0, res-body=") ||
+		!strings.Contains(response, "\r\n\r\nHTTP/1.1 403 Forbidden\r\n") ||
+		!strings.HasSuffix(response, "7\r\nblocked\r\n0\r\n\r\n") {
+		t.Errorf("Response to SatisfyWithResponse is %s (should be the 403 response)", response)
+	}
+}
+
+func TestBufferBody(t *testing.T) {
+	request := "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: req-hdr=0, null-body=62\r\n" +
+		"\r\n" +
+		"GET /origin-resource HTTP/1.1\r\n" +
+		"Host: www.origin-server.com\r\n" +
+		"\r\n"
+
+	response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+		resp := &http.Response{
+			StatusCode: http.StatusForbidden,
+			Proto:      "HTTP/1.1",
+			Header:     http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"999"}},
+		}
+		BufferBody(w)
+		SatisfyWithResponse(w, resp, true)
+		io.WriteString(w, "ICAP ")
+		w.(Flusher).Flush()
+		io.WriteString(w, "powered!")
+	}), t)
+	if !strings.Contains(response, "\r\n\r\nHTTP/1.1 403 Forbidden\r\n") ||
+		!strings.Contains(response, "\r\nContent-Length: 13\r\n\r\n") ||
+		strings.Contains(response, "999") ||
+		!strings.HasSuffix(response, "\r\n\r\nd\r\nICAP powered!\r\n0\r\n\r\n") {
+		t.Errorf("Response with BufferBody is %s (should have Content-Length: 13)", response)
+	}
+	if err := ValidateResponse(strings.NewReader(response)); err != nil {
+		t.Errorf("invalid response: %v", err)
+	}
+
+	// An empty body has a Content-Length of 0.
+	response = roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+		BufferBody(w)
+		ModifyRequest(w, req.Request, true)
+	}), t)
+	if !strings.Contains(response, "\r\nContent-Length: 0\r\n\r\n0\r\n\r\n") {
+		t.Errorf("Response with BufferBody and no body is %s (should have Content-Length: 0)", response)
+	}
+
+	// BufferBody finds the server's ResponseWriter through wrappers
+	// with an Unwrap method, and has no effect through others.
+	for _, c := range []struct {
+		wrap   func(ResponseWriter) ResponseWriter
+		length bool
+	}{
+		{func(w ResponseWriter) ResponseWriter { return unwrapper{w} }, true},
+		{func(w ResponseWriter) ResponseWriter { return struct{ ResponseWriter }{w} }, false},
+	} {
+		response = roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+			w = c.wrap(w)
+			BufferBody(w)
+			ModifyRequest(w, req.Request, true)
+		}), t)
+		if strings.Contains(response, "\r\nContent-Length: 0\r\n") != c.length {
+			t.Errorf("Response with BufferBody through %T is %s", c.wrap(nil), response)
+		}
+	}
+}
+
+// An unwrapper wraps a ResponseWriter, as middleware might.
+type unwrapper struct {
+	ResponseWriter
+}
+
+func (w unwrapper) Unwrap() ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestContinue(t *testing.T) {
+	request := "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Preview: 5\r\n" +
+		"Encapsulated: req-hdr=0, req-body=63\r\n" +
+		"\r\n" +
+		"POST /origin-resource HTTP/1.1\r\n" +
+		"Host: www.origin-server.com\r\n" +
+		"\r\n" +
+		"5\r\n" +
+		"hello\r\n" +
+		"0\r\n" +
+		"\r\n" +
+		"6\r\n" +
+		" world\r\n" +
+		"0\r\n" +
+		"\r\n"
+	response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+		if err := Continue(w, req); err != nil {
+			t.Errorf("Continue: %v", err)
+		}
+		body, _ := ioutil.ReadAll(req.Request.Body)
+		checkString("Body", string(body), "hello world", t)
+		w.WriteHeader(204, nil, false)
+		if err := Continue(w, req); err == nil {
+			t.Error("no error from Continue after WriteHeader")
+		}
+	}), t)
+	if !strings.HasPrefix(response, "ICAP/1.0 100 Continue\r\n\r\nICAP/1.0 204 No Modifications\r\n") {
+		t.Errorf("Response is %q (should be 100 Continue, then 204)", response)
+	}
+
+	response = roundTrip(reqmodNoBody, HandlerFunc(func(w ResponseWriter, req *Request) {
+		if err := Continue(w, req); err == nil {
+			t.Error("no error from Continue without a preview")
+		}
+		w.WriteHeader(204, nil, false)
+	}), t)
+	if strings.Contains(response, "100 Continue") {
+		t.Errorf("Response is %q (should not contain 100 Continue)", response)
+	}
+}
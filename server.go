@@ -9,11 +9,18 @@ package icap
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -40,19 +47,33 @@ func (f HandlerFunc) ServeICAP(w ResponseWriter, r *Request) {
 // A conn represents the server side of an ICAP connection.
 type conn struct {
 	remoteAddr string            // network address of remote side
+	server     *Server           // the Server on which the connection arrived
 	handler    Handler           // request handler
 	rwc        net.Conn          // i/o connection
+	cr         *connReader       // reads from rwc for buf
+	cw         *countingWriter   // writes to rwc for buf
 	buf        *bufio.ReadWriter // buffered rwc
+
+	readDeadline time.Time   // the read deadline from Server.ReadTimeout, if any
+	requests     int         // the number of requests read so far
+	timer        *time.Timer // the current request's RequestTimeout timer, if any
+
+	mu       sync.Mutex // guards state and timedOut
+	state    connState
+	timedOut bool // the request timer has expired
 }
 
 // Create new connection from rwc.
-func newConn(rwc net.Conn, handler Handler) (c *conn, err error) {
+func newConn(rwc net.Conn, srv *Server, handler Handler) (c *conn, err error) {
 	c = new(conn)
 	c.remoteAddr = rwc.RemoteAddr().String()
+	c.server = srv
 	c.handler = handler
 	c.rwc = rwc
-	br := bufio.NewReader(rwc)
-	bw := bufio.NewWriter(rwc)
+	c.cr = newConnReader(rwc)
+	br := bufio.NewReaderSize(c.cr, bufferSize(srv.ReadBufferSize))
+	c.cw = &countingWriter{w: rwc}
+	bw := bufio.NewWriterSize(c.cw, bufferSize(srv.WriteBufferSize))
 	c.buf = bufio.NewReadWriter(br, bw)
 
 	return c, nil
@@ -60,20 +81,213 @@ func newConn(rwc net.Conn, handler Handler) (c *conn, err error) {
 
 // Read next request from connection.
 func (c *conn) readRequest() (w *respWriter, err error) {
-	var req *Request
-	if req, err = ReadRequest(c.buf); err != nil {
+	// The read limit set by serveRequest applies only to the ICAP
+	// header; readEncapsulated limits the encapsulated HTTP headers to
+	// MaxHeaderBytes as well, and the preview to MaxPreviewBytes.
+	req, err := readRequestHeader(c.buf.Reader, c.server)
+	hitLimit := c.cr.hitReadLimit()
+	c.cr.setReadLimit(-1)
+	if hitLimit && err != nil {
+		return nil, errHeaderTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = readEncapsulated(req, c.buf, c.server); err != nil {
 		return nil, err
 	}
 
 	req.RemoteAddr = c.remoteAddr
+	req.remoteAddr = c.rwc.RemoteAddr()
+	req.localAddr = c.rwc.LocalAddr()
+	c.requests++
+	req.ConnRequestNum = c.requests
+	if req.body != nil && !req.PreviewEOF {
+		// Once the body has been read, watch for the client going away.
+		req.setBody(&eofSignal{req.body, c.cr.startBackgroundRead})
+	}
 
 	w = new(respWriter)
 	w.conn = c
 	w.req = req
 	w.header = make(http.Header)
+	if c.server != nil && c.server.StrictResponseValidation {
+		w.recorded = new(bytes.Buffer)
+		w.record = bufio.NewWriter(w.recorded)
+	}
 	return w, nil
 }
 
+// sendValidated sends resp, the response to req that was held back for
+// Server.StrictResponseValidation, if it is valid. If it isn't, the
+// problem is logged, and a 500 Internal Server Error is sent instead.
+func (c *conn) sendValidated(req *Request, resp []byte) (ok bool) {
+	if err := validateResponse(bytes.NewReader(resp), req.Method); err != nil {
+		c.server.logf("icap: INVALID RESPONSE from handler for %s %s: %v", req.Method, req.RawURL, err)
+		c.writeStatus(http.StatusInternalServerError)
+		return false
+	}
+	c.buf.Write(resp)
+	c.buf.Flush()
+	return true
+}
+
+// An optionsProvider is a Handler, such as a ServeMux, that knows the
+// capabilities of the services it handles.
+type optionsProvider interface {
+	OptionsFor(r *Request) *Options
+}
+
+// serveOptions answers an OPTIONS request from the Options registered
+// with the connection's handler, without calling the handler itself.
+func (c *conn) serveOptions(w *respWriter) {
+	if p, ok := c.handler.(optionsProvider); ok {
+		if o := p.OptionsFor(w.req); o != nil {
+			if o.MaxConnections == 0 && c.server != nil && c.server.MaxConnections > 0 {
+				o2 := *o
+				o2.MaxConnections = c.server.MaxConnections
+				o = &o2
+			}
+			o.Write(w)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound, nil, false)
+}
+
+// logReadError logs an error that occurred while reading a request.
+// A client closing the connection before starting a request is normal,
+// and is not logged; a reset is reported as such.
+func (c *conn) logReadError(err error) {
+	switch {
+	case err == io.EOF, errors.Is(err, net.ErrClosed):
+	case errors.Is(err, syscall.ECONNRESET):
+		c.server.logf("icap: connection reset by %s while reading request", c.remoteAddr)
+	default:
+		c.server.logf("icap: error while reading request from %s: %v", c.remoteAddr, err)
+	}
+}
+
+// writeStatus sends a response with status code and no body, for when
+// there is no request to pass to the handler.
+func (c *conn) writeStatus(code int) {
+	w := new(respWriter)
+	w.conn = c
+	w.req = new(Request)
+	w.header = make(http.Header)
+	w.closeAfter = true
+	w.WriteHeader(code, nil, false)
+	w.finishRequest()
+}
+
+// waitForRequestLine waits until a complete request line has been
+// received, for no longer than the server's RequestLineTimeout. The
+// connection is idle, and may be closed by Shutdown, until the first
+// byte of the request arrives; then the request timer is started, with
+// cancel to cancel the request's context.
+func (c *conn) waitForRequestLine(cancel context.CancelFunc) error {
+	if c.server == nil || c.server.RequestLineTimeout <= 0 {
+		if _, err := c.buf.Reader.Peek(1); err != nil {
+			return err
+		}
+		c.startRequestTimer(cancel)
+		return c.markActive()
+	}
+	deadline := time.Now().Add(c.server.RequestLineTimeout)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+		deadline = c.readDeadline
+	}
+	c.rwc.SetReadDeadline(deadline)
+	defer func() {
+		c.mu.Lock()
+		if !c.timedOut {
+			c.rwc.SetReadDeadline(c.readDeadline)
+		}
+		c.mu.Unlock()
+	}()
+
+	// Peek one more byte at a time; Peek only reads from the connection
+	// when the buffer doesn't already hold enough.
+	br := c.buf.Reader
+	for n := 1; ; n++ {
+		p, err := br.Peek(n)
+		if err == bufio.ErrBufferFull {
+			// Too long to be a request line; let ReadRequest report it.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n == 1 {
+			c.startRequestTimer(cancel)
+			if err := c.markActive(); err != nil {
+				return err
+			}
+		}
+		if p[n-1] == '\n' {
+			return nil
+		}
+	}
+}
+
+// startRequestTimer starts timing the request that has just started to
+// arrive against the server's RequestTimeout. When the timer expires,
+// reads and writes on the connection fail, and cancel is called.
+func (c *conn) startRequestTimer(cancel context.CancelFunc) {
+	if c.server == nil || c.server.RequestTimeout <= 0 {
+		return
+	}
+	c.timer = time.AfterFunc(c.server.RequestTimeout, func() {
+		c.mu.Lock()
+		c.timedOut = true
+		c.rwc.SetReadDeadline(time.Unix(1, 0))
+		c.rwc.SetWriteDeadline(time.Unix(1, 0))
+		c.mu.Unlock()
+		cancel()
+	})
+}
+
+// stopRequestTimer stops the request timer, and reports whether it had
+// already expired.
+func (c *conn) stopRequestTimer() bool {
+	if c.timer == nil {
+		return false
+	}
+	if c.timer.Stop() {
+		c.timer = nil
+		return false
+	}
+	c.timer = nil
+	// The timer's function may still be running.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.timedOut
+}
+
+// timeoutResponseGrace is how long a 408 Request Timeout response has
+// to be written after the request timer has cut off writes.
+const timeoutResponseGrace = time.Second
+
+// errHeaderTooLarge is returned by readRequest when the ICAP header is
+// longer than Server.MaxHeaderBytes.
+var errHeaderTooLarge = &requestError{http.StatusBadRequest, "ICAP header too large"}
+
+// rstAvoidanceDelay is how long closeWriteAndWait gives the client to
+// read the response before the connection is closed. Closing it with
+// unread data makes the kernel send a reset, and the client may then
+// lose the response.
+const rstAvoidanceDelay = 500 * time.Millisecond
+
+// closeWriteAndWait flushes the response, and shuts down the writing
+// side of the connection, if it can, before waiting rstAvoidanceDelay.
+func (c *conn) closeWriteAndWait() {
+	c.buf.Flush()
+	if tc, ok := c.rwc.(interface{ CloseWrite() error }); ok {
+		tc.CloseWrite()
+	}
+	time.Sleep(rstAvoidanceDelay)
+}
+
 // Close the connection.
 func (c *conn) close() {
 	if c.buf != nil {
@@ -88,60 +302,589 @@ func (c *conn) close() {
 
 // Serve a new connection.
 func (c *conn) serve() {
+	var w *respWriter
+	defer func() {
+		if w != nil {
+			w.req.removeTempFiles()
+		}
+	}()
 	defer func() {
 		err := recover()
 		if err == nil {
 			return
 		}
+		if w != nil && c.server != nil && c.server.PanicHandler != nil && c.handlePanic(w, err) {
+			return
+		}
+		if w != nil && !w.wroteHeader {
+			c.sendPanicError(w)
+		}
 		c.rwc.Close()
 
 		var buf bytes.Buffer
 		fmt.Fprintf(&buf, "icap: panic serving %v: %v\n", c.remoteAddr, err)
 		buf.Write(debug.Stack())
-		log.Print(buf.String())
+		c.server.logf("%s", buf.String())
 	}()
 
-	w, err := c.readRequest()
+	if tc, ok := c.rwc.(*tls.Conn); ok {
+		// Do the handshake now, so that a failure is reported as such,
+		// rather than as an error reading the request.
+		if err := tc.Handshake(); err != nil {
+			c.server.logf("icap: TLS handshake error from %s: %v", c.remoteAddr, err)
+			c.close()
+			return
+		}
+	}
+
+	for {
+		if !c.serveRequest(&w) {
+			break
+		}
+		w.req.removeTempFiles()
+		w = nil
+	}
+	c.close()
+}
+
+// serveRequest reads a request from the connection and answers it,
+// setting *wp to its respWriter once it has been read. It reports
+// whether the connection can be used for another request.
+func (c *conn) serveRequest(wp **respWriter) bool {
+	c.cr.setReadLimit(int64(c.server.maxHeaderBytes()))
+	c.markIdle()
+	if c.requests > 0 {
+		if !c.waitForNextRequest() {
+			return false
+		}
+		c.resetDeadlines()
+	}
+
+	// The request timer starts when the request starts to arrive. When it
+	// expires, it cuts off reads and writes and cancels the context, so a
+	// handler blocked on the connection gets an error.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	read, written := c.bytesRead(), c.bytesWritten()
+	err := c.waitForRequestLine(cancel)
+	start := time.Now()
+	var w *respWriter
+	if err == nil {
+		w, err = c.readRequest()
+	}
 	if err != nil {
-		log.Println("error while reading request:", err)
-		c.rwc.Close()
-		return
+		if c.stopRequestTimer() {
+			c.rwc.SetWriteDeadline(time.Now().Add(timeoutResponseGrace))
+			c.writeStatus(http.StatusRequestTimeout)
+			return false
+		}
+		c.logReadError(err)
+		switch e := err.(type) {
+		case *requestError:
+			c.writeStatus(e.code)
+		case *HTTPParseError:
+			c.writeStatus(http.StatusBadRequest)
+		}
+		if err == errHeaderTooLarge || err == errEncapsulatedTooLarge {
+			// The rest of the header is still unread.
+			c.closeWriteAndWait()
+		}
+		return false
+	}
+	*wp = w
+
+	w.req.ctx = ctx
+	c.cr.setCancel(cancel)
+	defer c.cr.setCancel(nil)
+	if w.req.body == nil || w.req.PreviewEOF {
+		c.cr.startBackgroundRead()
 	}
 
-	c.handler.ServeICAP(w, w.req)
+	if c.server != nil && c.server.AutoOptions && w.req.Method == "OPTIONS" {
+		c.serveOptions(w)
+	} else if c.server.acquireRequest() {
+		defer c.server.releaseRequest()
+		c.handler.ServeICAP(w, w.req)
+	} else {
+		w.WriteHeader(StatusServiceOverloaded, nil, false)
+	}
+	timedOut := c.stopRequestTimer()
+	if timedOut && !w.wroteHeader {
+		c.rwc.SetWriteDeadline(time.Now().Add(timeoutResponseGrace))
+		w.WriteHeader(http.StatusRequestTimeout, nil, false)
+	}
 	w.finishRequest()
+	c.cr.abortPendingRead(c.readDeadline)
+
+	keepAlive := !timedOut && !w.closeAfter && w.err == nil && w.req.drainBody()
+	if c.server != nil && c.server.OnRequest != nil {
+		c.server.OnRequest(w.req, &RequestInfo{
+			Status:           w.status,
+			BytesRead:        c.bytesRead() - read,
+			BytesWritten:     c.bytesWritten() - written,
+			BodyBytesWritten: w.bodyBytes,
+			Start:            start,
+			Duration:         time.Since(start),
+		})
+	}
+	return keepAlive
+}
+
+// waitForNextRequest waits, for no longer than the server's IdleTimeout,
+// for the next request on a connection that has been kept open to start
+// to arrive. It reports whether one did.
+func (c *conn) waitForNextRequest() bool {
+	if c.server.IdleTimeout <= 0 {
+		return true
+	}
+	c.rwc.SetReadDeadline(time.Now().Add(c.server.IdleTimeout))
+	if _, err := c.buf.Reader.Peek(1); err != nil {
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			c.logReadError(err)
+		}
+		return false
+	}
+	return true
+}
 
+// resetDeadlines sets the connection's deadlines for a new request
+// on a connection that has been kept open.
+func (c *conn) resetDeadlines() {
+	c.readDeadline = time.Time{}
+	if c.server.ReadTimeout != 0 {
+		c.readDeadline = time.Now().Add(c.server.ReadTimeout)
+	}
+	c.rwc.SetReadDeadline(c.readDeadline)
+	if c.server.WriteTimeout != 0 {
+		c.rwc.SetWriteDeadline(time.Now().Add(c.server.WriteTimeout))
+	}
+}
+
+// keepAlive reports whether the connection may be kept open after a
+// response to req with status code. See Server.DisableKeepAlives.
+func (c *conn) keepAlive(req *Request, code int) bool {
+	return c.server != nil && !c.server.DisableKeepAlives && !c.server.shuttingDown() && !req.Close &&
+		code != http.StatusRequestTimeout && code < 500
+}
+
+// handlePanic passes v, recovered from a panic in the handler, to the
+// server's PanicHandler, and finishes the response. It reports whether
+// that succeeded; if the PanicHandler panics too, it returns false.
+func (c *conn) handlePanic(w *respWriter, v interface{}) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	w.closeAfter = true
+	c.server.PanicHandler(w, w.req, v)
+	w.finishRequest()
 	c.close()
+	return true
+}
+
+// sendPanicError answers the request with 500 Server Error when the
+// handler has panicked before starting a response, so that the client
+// need not wait for a timeout. Any headers the handler set are
+// discarded. A panic while writing the response is ignored.
+func (c *conn) sendPanicError(w *respWriter) {
+	defer func() { recover() }()
+	w.header = make(http.Header)
+	w.rawHeader = nil
+	w.closeAfter = true
+	w.WriteHeader(http.StatusInternalServerError, nil, false)
+	w.finishRequest()
 }
 
 // A Server defines parameters for running an ICAP server.
 type Server struct {
-	Addr         string  // TCP address to listen on, ":1344" if empty
-	Handler      Handler // handler to invoke
-	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
+	Addr         string        // address to listen on, ":1344" if empty
+	Handler      Handler       // handler to invoke
+	ReadTimeout  time.Duration // maximum time to read each request; zero means no limit
+	WriteTimeout time.Duration // maximum time to write each response; zero means no limit
+
+	// Network is the network that ListenAndServe and ListenAndServeTLS
+	// listen on, as for net.Listen. If it is empty, "tcp" is used. For
+	// a Unix domain socket, it is "unix" and Addr is the socket's path;
+	// the socket file is removed when the listener is closed.
+	Network string
+
+	// IdleTimeout is the maximum time to wait for the next request on a
+	// connection that has been kept open. ReadTimeout then applies from
+	// when the request starts to arrive. If IdleTimeout is zero, there
+	// is no separate limit, and ReadTimeout includes the time between
+	// requests.
+	IdleTimeout time.Duration
+
+	// RequestTimeout is the maximum duration of a request, from when
+	// its first byte arrives to flushing the response. Time spent idle
+	// between requests does not count. When it expires, reads and writes
+	// on the connection fail, the request's context is canceled, and if
+	// the handler has not written a response yet, a 408 Request Timeout
+	// is sent. The connection is then closed.
+	RequestTimeout time.Duration
+
+	// RequestLineTimeout is the maximum time allowed for the client to
+	// send the first line of the request, counted from when the server
+	// starts waiting for it. If it is zero, there is no separate limit.
+	RequestLineTimeout time.Duration
+
+	// MaxICAPHeaders is the maximum number of header fields allowed in
+	// the ICAP header of a request (not counting the encapsulated HTTP
+	// headers). Requests with more are rejected with 400 Bad Request.
+	// If it is zero, there is no limit.
+	MaxICAPHeaders int
+
+	// MaxHeaderBytes is the maximum size of the request line and ICAP
+	// header of a request, counted as bytes read from the connection,
+	// and separately of the encapsulated HTTP headers together.
+	// Requests with more are rejected with 400 Bad Request.
+	// If it is zero, DefaultMaxHeaderBytes is used.
+	MaxHeaderBytes int
+
+	// ReadBufferSize and WriteBufferSize are the sizes of the buffers
+	// for reading from and writing to each connection. Larger buffers
+	// mean fewer system calls when large bodies are adapted, at the cost
+	// of more memory for each connection. If they are zero, 4096 bytes
+	// is used.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// MaxPreviewBytes is the largest preview the server will accept.
+	// Requests with a larger Preview header, or that send more preview
+	// data than that, are rejected with 400 Bad Request.
+	// If it is zero, DefaultMaxPreviewBytes is used. ReadRequest, with no
+	// Server, applies no limit.
+	MaxPreviewBytes int
+
+	// StrictHTTP makes the server reject requests whose encapsulated HTTP
+	// headers could be used for request smuggling, such as a message with
+	// both Content-Length and Transfer-Encoding, or with more than one
+	// Content-Length. They are answered with 400 Bad Request.
+	StrictHTTP bool
+
+	// StrictEncapsulated makes the server reject requests whose
+	// Encapsulated header ends with a header section (such as just
+	// "req-hdr=0"), instead of a body section as RFC 3507 requires.
+	// By default such a request is read as if the header were followed
+	// by a null-body section, with the last HTTP header ending at the
+	// first blank line.
+	StrictEncapsulated bool
+
+	// AutoOptions makes the server answer OPTIONS requests itself, from
+	// the Options registered with the Handler (see ServeMux.SetOptions),
+	// instead of passing them to the Handler. If no Options match the
+	// request, it is answered with 404.
+	AutoOptions bool
+
+	// TLSConfig optionally provides a TLS configuration for use by
+	// ListenAndServeTLS. It is cloned, and the certificate from
+	// ListenAndServeTLS's arguments added to the clone.
+	TLSConfig *tls.Config
+
+	// OnRequest, if not nil, is called after each request has been
+	// answered and its body read, with how it was answered; it can
+	// write an access log, for example. It is called on the
+	// connection's goroutine, so the next request on the connection
+	// waits for it. It is not called for requests that could not be
+	// read, nor if the handler panics.
+	OnRequest func(req *Request, info *RequestInfo)
+
+	// OnListen, if not nil, is called by ListenAndServe with the address
+	// it is listening on, before it starts accepting connections. This
+	// reports the actual port when Addr specifies port 0.
+	OnListen func(net.Addr)
+
+	// StrictResponseValidation makes the server check each response
+	// the handler writes before sending it, as ValidateResponse does,
+	// and also that it has the headers required for its status: ISTag,
+	// and Methods in the reply to OPTIONS. An invalid response is logged
+	// and replaced with 500 Internal Server Error. The whole response is
+	// held in memory until the handler returns, so Flush has no effect;
+	// this is meant for finding bugs in handlers during development.
+	StrictResponseValidation bool
+
+	// DisableKeepAlives makes the server close each connection after
+	// one request. Otherwise connections are kept open for further
+	// requests, as long as the connection is left in a known state after
+	// each response. It is closed instead if:
+	//   - the client sent "Connection: close";
+	//   - the server is shutting down (see Shutdown);
+	//   - the request could not be parsed, so the server answered it itself;
+	//   - the status is 408 Request Timeout, or 500 or above;
+	//   - the handler panicked, or writing the response failed;
+	//   - the rest of the request body could not be read and discarded
+	//     (a response during a preview leaves nothing more to read).
+	// Responses after which the connection is closed have a
+	// "Connection: close" header; the others, "Connection: keep-alive".
+	DisableKeepAlives bool
+
+	// DisableNoDelay clears TCP_NODELAY on accepted TCP connections,
+	// including those under TLS, so that Nagle's algorithm combines
+	// small writes (from a handler that calls Flush often, for example)
+	// into fewer segments, at the cost of latency. By default, as
+	// elsewhere in Go, TCP_NODELAY is set and each write is sent at once;
+	// the server writes the header of a response, and usually a small
+	// response in its entirety, in one write.
+	DisableNoDelay bool
+
+	// MaxAcceptRate is the maximum number of connections accepted per
+	// second. When connections arrive faster than that, the server waits
+	// before accepting the next one, and they queue in the listener's
+	// backlog. If it is zero, there is no limit.
+	MaxAcceptRate float64
+
+	// MaxConcurrentRequests is the maximum number of requests being
+	// handled at once, across all connections. A request that arrives
+	// when that many are in the handler is answered straight away with
+	// 503 Service Overloaded, so that the client can apply its own
+	// policy (such as bypassing the service) instead of waiting. OPTIONS
+	// requests answered by AutoOptions are not counted. If it is zero,
+	// there is no limit.
+	MaxConcurrentRequests int
+
+	// MaxConnections is the maximum number of connections served at
+	// once. Connections accepted beyond it are closed straight away.
+	// If it is zero, there is no limit. It is also advertised as the
+	// Max-Connections header of OPTIONS responses sent for AutoOptions,
+	// unless the service's Options give a value.
+	MaxConnections int
+
+	// MaxIdleConns is the maximum number of kept-alive connections left
+	// open between requests. When another one becomes idle, the one
+	// that has been idle the longest is closed. If it is zero, there is
+	// no limit.
+	MaxIdleConns int
+
+	// ISTag, if it is not empty, is sent as the ISTag header of every
+	// response, including OPTIONS responses and the errors the server
+	// sends itself, unless the handler sets a different one. It
+	// includes the quotes, as in Options.ISTag. It should change
+	// whenever the service's configuration does, so that clients
+	// discard results they have cached.
+	ISTag string
+
+	// DefaultResponseHeaders are added to the ICAP header of every
+	// response, such as the ISTag and Service headers that would
+	// otherwise be set by each handler. A header set by the handler
+	// takes precedence over the default with the same key.
+	DefaultResponseHeaders http.Header
+
+	// PanicHandler, if not nil, is called with the value recovered when
+	// the handler panics, and may respond to the request; for example, a
+	// handler may panic with a value of its own type to block a request,
+	// and PanicHandler answer it with a 403. If the handler has already
+	// started its response, the PanicHandler can only add to it. If
+	// PanicHandler is nil, or panics itself, the panic is logged, the
+	// request is answered with 500 Server Error if the response has not
+	// been started, and the connection is closed.
+	PanicHandler func(w ResponseWriter, req *Request, v interface{})
+
+	// ErrorLog specifies an optional logger for errors accepting
+	// connections, reading requests, and panics in handlers.
+	// If it is nil, logging goes to the log package's standard logger.
+	ErrorLog *log.Logger
+
+	// Proto is the protocol version written in the status line of
+	// responses, including "100 Continue". If it is empty, "ICAP/1.0"
+	// is used.
+	Proto string
+
+	activeConns int32         // the number of connections being served; accessed atomically
+	requestSem  chan struct{} // holds a value for each request in the handler, for MaxConcurrentRequests
+	inShutdown  int32         // set by Shutdown or Close; accessed atomically
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	idleConns []*conn // kept-alive connections between requests, oldest first, for MaxIdleConns
+}
+
+// ActiveConns returns the number of connections that srv is serving:
+// ones that have been accepted, and whose goroutines have not finished.
+// A count that keeps growing while the load is steady points to
+// connections that are stuck.
+func (srv *Server) ActiveConns() int {
+	return int(atomic.LoadInt32(&srv.activeConns))
+}
+
+// acquireConn counts a new connection in activeConns, and reports
+// whether that is within srv.MaxConnections.
+func (srv *Server) acquireConn() bool {
+	for {
+		n := atomic.LoadInt32(&srv.activeConns)
+		if srv.MaxConnections > 0 && int(n) >= srv.MaxConnections {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&srv.activeConns, n, n+1) {
+			return true
+		}
+	}
+}
+
+// acquireRequest takes a place for a request in the handler, and
+// reports whether there was one free under srv.MaxConcurrentRequests.
+func (srv *Server) acquireRequest() bool {
+	if srv == nil || srv.requestSem == nil {
+		return true
+	}
+	select {
+	case srv.requestSem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseRequest gives up the place taken by acquireRequest.
+func (srv *Server) releaseRequest() {
+	if srv != nil && srv.requestSem != nil {
+		<-srv.requestSem
+	}
+}
+
+// DefaultMaxHeaderBytes is the default value of Server.MaxHeaderBytes.
+const DefaultMaxHeaderBytes = 1 << 20
+
+// maxHeaderBytes returns the header size limit for srv, which may be nil.
+func (srv *Server) maxHeaderBytes() int {
+	if srv == nil || srv.MaxHeaderBytes <= 0 {
+		return DefaultMaxHeaderBytes
+	}
+	return srv.MaxHeaderBytes
+}
+
+// defaultBufferSize is the size of connection buffers when
+// Server.ReadBufferSize or Server.WriteBufferSize is zero; it is the
+// same as bufio's default.
+const defaultBufferSize = 4096
+
+// bufferSize returns n, or defaultBufferSize if n is not positive.
+func bufferSize(n int) int {
+	if n <= 0 {
+		return defaultBufferSize
+	}
+	return n
+}
+
+// DefaultMaxPreviewBytes is the default value of Server.MaxPreviewBytes.
+const DefaultMaxPreviewBytes = 64 << 10
+
+// maxPreviewBytes returns the preview size limit for srv, which may be nil.
+func (srv *Server) maxPreviewBytes() int {
+	if srv == nil || srv.MaxPreviewBytes <= 0 {
+		return DefaultMaxPreviewBytes
+	}
+	return srv.MaxPreviewBytes
+}
+
+// logf logs to srv.ErrorLog, or the standard logger; srv may be nil.
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv != nil && srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// proto returns the protocol version to use in responses.
+func (srv *Server) proto() string {
+	if srv == nil || srv.Proto == "" {
+		return "ICAP/1.0"
+	}
+	return srv.Proto
 }
 
-// ListenAndServe listens on the TCP network address srv.Addr and then
-// calls Serve to handle requests on incoming connections.  If
-// srv.Addr is blank, ":1344" is used.
+// network returns the network for srv to listen on.
+func (srv *Server) network() string {
+	if srv.Network == "" {
+		return "tcp"
+	}
+	return srv.Network
+}
+
+// ListenAndServe listens on srv.Network (normally TCP) at the address
+// srv.Addr and then calls Serve to handle requests on incoming
+// connections.  If srv.Addr is blank, ":1344" is used.
 func (srv *Server) ListenAndServe() error {
+	if srv.shuttingDown() {
+		return ErrServerClosed
+	}
 	addr := srv.Addr
 	if addr == "" {
 		addr = ":1344"
 	}
-	l, e := net.Listen("tcp", addr)
+	l, e := net.Listen(srv.network(), addr)
 	if e != nil {
 		return e
 	}
+	if srv.OnListen != nil {
+		srv.OnListen(l.Addr())
+	}
 	return srv.Serve(l)
 }
 
+// ListenAndServeTLS listens on srv.Network (normally TCP) at the
+// address srv.Addr and then calls Serve to handle ICAP over TLS ("icaps") on incoming
+// connections. If srv.Addr is blank, ":11344" is used.
+//
+// certFile and keyFile are the server's certificate and matching
+// private key; the certificate file may hold intermediate certificates
+// after the server's. They may be empty if srv.TLSConfig already has a
+// certificate.
+func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	if srv.shuttingDown() {
+		return ErrServerClosed
+	}
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":11344"
+	}
+
+	config := new(tls.Config)
+	if srv.TLSConfig != nil {
+		config = srv.TLSConfig.Clone()
+	}
+	if certFile != "" || keyFile != "" || (len(config.Certificates) == 0 && config.GetCertificate == nil) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+
+	l, e := net.Listen(srv.network(), addr)
+	if e != nil {
+		return e
+	}
+	if srv.OnListen != nil {
+		srv.OnListen(l.Addr())
+	}
+	return srv.Serve(tls.NewListener(l, config))
+}
+
 // Serve accepts incoming connections on the Listener l, creating a
 // new service thread for each.  The service threads read requests and
 // then call srv.Handler to reply to them.
 func (srv *Server) Serve(l net.Listener) error {
 	defer l.Close()
+	if srv.MaxAcceptRate > 0 {
+		l = &rateLimitedListener{
+			Listener: l,
+			interval: time.Duration(float64(time.Second) / srv.MaxAcceptRate),
+		}
+	}
+	if !srv.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	if srv.MaxConcurrentRequests > 0 {
+		srv.mu.Lock()
+		if srv.requestSem == nil {
+			srv.requestSem = make(chan struct{}, srv.MaxConcurrentRequests)
+		}
+		srv.mu.Unlock()
+	}
+	defer srv.trackListener(l, false)
 	handler := srv.Handler
 	if handler == nil {
 		handler = DefaultServeMux
@@ -150,25 +893,75 @@ func (srv *Server) Serve(l net.Listener) error {
 	for {
 		rw, e := l.Accept()
 		if e != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
-				log.Printf("icap: Accept error: %v", e)
+				srv.logf("icap: Accept error: %v", e)
 				continue
 			}
 			return e
 		}
+		var readDeadline time.Time
 		if srv.ReadTimeout != 0 {
-			rw.SetReadDeadline(time.Now().Add(srv.ReadTimeout))
+			readDeadline = time.Now().Add(srv.ReadTimeout)
+			rw.SetReadDeadline(readDeadline)
 		}
 		if srv.WriteTimeout != 0 {
 			rw.SetWriteDeadline(time.Now().Add(srv.WriteTimeout))
 		}
-		c, err := newConn(rw, handler)
+		if srv.DisableNoDelay {
+			if tc := tcpConn(rw); tc != nil {
+				tc.SetNoDelay(false)
+			}
+		}
+		if !srv.acquireConn() {
+			srv.logf("icap: refusing connection from %s: already serving %d connections", rw.RemoteAddr(), srv.MaxConnections)
+			rw.Close()
+			continue
+		}
+		c, err := newConn(rw, srv, handler)
 		if err != nil {
+			atomic.AddInt32(&srv.activeConns, -1)
 			continue
 		}
-		go c.serve()
+		c.readDeadline = readDeadline
+		srv.trackConn(c, true)
+		go func() {
+			defer atomic.AddInt32(&srv.activeConns, -1)
+			defer srv.trackConn(c, false)
+			c.serve()
+		}()
+	}
+}
+
+// tcpConn returns the TCP connection under c, which may be a TLS
+// connection, or nil if there is none.
+func tcpConn(c net.Conn) *net.TCPConn {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
 	}
-	panic("not reached")
+	tc, _ := c.(*net.TCPConn)
+	return tc
+}
+
+// A rateLimitedListener accepts connections no more often than once
+// per interval.
+type rateLimitedListener struct {
+	net.Listener
+	interval time.Duration
+	next     time.Time // the earliest time to accept the next connection
+}
+
+func (l *rateLimitedListener) Accept() (net.Conn, error) {
+	if d := time.Until(l.next); d > 0 {
+		time.Sleep(d)
+	}
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.next = time.Now().Add(l.interval)
+	}
+	return c, err
 }
 
 // Serve accepts incoming ICAP connections on the listener l,
@@ -186,3 +979,10 @@ func ListenAndServe(addr string, handler Handler) error {
 	server := &Server{Addr: addr, Handler: handler}
 	return server.ListenAndServe()
 }
+
+// ListenAndServeTLS acts like ListenAndServe, but serves ICAP over TLS,
+// with the certificate and key in certFile and keyFile.
+func ListenAndServeTLS(addr, certFile, keyFile string, handler Handler) error {
+	server := &Server{Addr: addr, Handler: handler}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
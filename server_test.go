@@ -0,0 +1,1491 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	// The body is never finished, so the handler blocks reading it.
+	request :=
+		"REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: req-hdr=0, req-body=63\r\n" +
+			"\r\n" +
+			"POST /origin-resource HTTP/1.1\r\n" +
+			"Host: www.origin-server.com\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n"
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	srv := &Server{
+		RequestTimeout: 50 * time.Millisecond,
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			if _, err := ioutil.ReadAll(req.Request.Body); err == nil {
+				t.Error("reading body did not fail after timeout")
+			}
+			select {
+			case <-req.Context().Done():
+			case <-time.After(time.Second):
+				t.Error("request context was not canceled after timeout")
+			}
+		}),
+	}
+	go srv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, request)
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("error while reading response: %v", err)
+	}
+	if !strings.HasPrefix(string(response), "ICAP/1.0 408 Request Timeout\r\n") {
+		t.Fatalf("Response is %s (should be a 408)", response)
+	}
+}
+
+func TestRequestTimeoutIdle(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	var logBuf bytes.Buffer
+	srv := &Server{
+		RequestTimeout: 50 * time.Millisecond,
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(204, nil, false)
+		}),
+		ErrorLog: log.New(&logBuf, "", 0),
+	}
+	go srv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	// Time spent idle before and between requests doesn't count.
+	for i := 0; i < 2; i++ {
+		time.Sleep(150 * time.Millisecond)
+		io.WriteString(conn, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n")
+		response, err := readResponseHeader(br)
+		if err != nil {
+			t.Fatalf("request %d: error while reading response: %v", i, err)
+		}
+		if !strings.HasPrefix(response, "ICAP/1.0 204 No Modifications\r\n") {
+			t.Fatalf("request %d: response is %s (should be a 204)", i, response)
+		}
+	}
+	conn.Close()
+	srv.Shutdown(context.Background())
+	if logBuf.Len() != 0 {
+		t.Errorf("unexpected log output: %s", logBuf.String())
+	}
+}
+
+func TestMaxICAPHeaders(t *testing.T) {
+	request :=
+		"OPTIONS icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"X-Foo: 1\r\n" +
+			"X-Foo: 2\r\n" +
+			"X-Bar: 3\r\n" +
+			"\r\n"
+	srv := &Server{
+		MaxICAPHeaders: 3,
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			t.Error("handler called for request with too many headers")
+		}),
+	}
+
+	response := serverRoundTrip(srv, request, t)
+	if !strings.HasPrefix(response, "ICAP/1.0 400 Bad Request\r\n") {
+		t.Fatalf("Response is %s (should be a 400)", response)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	srv := &Server{
+		MaxHeaderBytes: 200,
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(204, nil, false)
+		}),
+	}
+	request := "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"X-Padding: " + strings.Repeat("x", 100) + "\r\n" +
+		"\r\n"
+	response := serverRoundTrip(srv, request, t)
+	if !strings.HasPrefix(response, "ICAP/1.0 204 No Modifications\r\n") {
+		t.Fatalf("Response is %s (should be a 204)", response)
+	}
+
+	request = "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"X-Padding: " + strings.Repeat("x", 200) + "\r\n" +
+		"\r\n"
+	response = serverRoundTrip(srv, request, t)
+	if !strings.HasPrefix(response, "ICAP/1.0 400 Bad Request\r\n") {
+		t.Fatalf("Response is %s (should be a 400)", response)
+	}
+}
+
+func TestMaxEncapsulatedHeaderBytes(t *testing.T) {
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			t.Error("handler called for request with too large an encapsulated header")
+		}),
+	}
+
+	// The offsets claim a huge header, which is not allocated.
+	request := "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: req-hdr=0, null-body=1000000000\r\n" +
+		"\r\n" +
+		"GET / HTTP/1.1\r\n"
+	response := serverRoundTrip(srv, request, t)
+	if !strings.HasPrefix(response, "ICAP/1.0 400 Bad Request\r\n") {
+		t.Fatalf("Response is %s (should be a 400)", response)
+	}
+
+	// MaxHeaderBytes applies to the encapsulated headers together.
+	srv = &Server{
+		MaxHeaderBytes: 200,
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(204, nil, false)
+		}),
+	}
+	for _, c := range []struct {
+		padding int
+		status  string
+	}{
+		{50, "ICAP/1.0 204 No Modifications\r\n"},
+		{150, "ICAP/1.0 400 Bad Request\r\n"},
+	} {
+		reqHdr := "GET /origin-resource HTTP/1.1\r\n" +
+			"Host: www.origin-server.com\r\n" +
+			"X-Padding: " + strings.Repeat("x", c.padding) + "\r\n" +
+			"\r\n"
+		resHdr := "HTTP/1.1 200 OK\r\n" +
+			"\r\n"
+		request := "RESPMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			fmt.Sprintf("Encapsulated: req-hdr=0, res-hdr=%d, null-body=%d\r\n", len(reqHdr), len(reqHdr)+len(resHdr)) +
+			"\r\n" +
+			reqHdr + resHdr
+		response := serverRoundTrip(srv, request, t)
+		if !strings.HasPrefix(response, c.status) {
+			t.Errorf("Response with %d bytes of padding is %s (should start with %q)", c.padding, response, c.status)
+		}
+
+		// Without the null-body section, the last header is read up to
+		// its blank line, and is limited the same way.
+		request = "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: req-hdr=0\r\n" +
+			"\r\n" +
+			reqHdr
+		response = serverRoundTrip(srv, request, t)
+		if !strings.HasPrefix(response, c.status) {
+			t.Errorf("Response with %d bytes of padding and no null-body is %s (should start with %q)", c.padding, response, c.status)
+		}
+	}
+}
+
+func TestMaxPreviewBytes(t *testing.T) {
+	srv := &Server{
+		MaxPreviewBytes: 4,
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			t.Error("handler called for request with too large a preview")
+		}),
+	}
+
+	// The Preview header asks for too much.
+	response := serverRoundTrip(srv, previewRequest("5\r\nhello\r\n0\r\n\r\n"), t)
+	if !strings.HasPrefix(response, "ICAP/1.0 400 Bad Request\r\n") {
+		t.Fatalf("Response is %s (should be a 400)", response)
+	}
+
+	// The client sends more than it advertised.
+	request := strings.Replace(previewRequest("5\r\nhello\r\n0\r\n\r\n"), "Preview: 5", "Preview: 3", 1)
+	response = serverRoundTrip(srv, request, t)
+	if !strings.HasPrefix(response, "ICAP/1.0 400 Bad Request\r\n") {
+		t.Fatalf("Response is %s (should be a 400)", response)
+	}
+}
+
+func TestAutoOptions(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("/scan", func(w ResponseWriter, req *Request) {
+		t.Error("handler called for OPTIONS request")
+	})
+	mux.SetOptions("/scan", &Options{
+		Methods: []string{"RESPMOD"},
+		ISTag:   "\"scan-1\"",
+	})
+	srv := &Server{AutoOptions: true, Handler: mux}
+
+	response := serverRoundTrip(srv, "OPTIONS icap://icap-server.net/scan ICAP/1.0\r\n"+
+		"Host: icap-server.net\r\n"+
+		"\r\n", t)
+	if !strings.HasPrefix(response, "ICAP/1.0 200 OK\r\n") {
+		t.Fatalf("Response is %s (should be a 200)", response)
+	}
+	if !strings.Contains(response, "Methods: RESPMOD\r\n") || !strings.Contains(response, "Istag: \"scan-1\"\r\n") {
+		t.Fatalf("Response is %s (should have the registered options)", response)
+	}
+
+	response = serverRoundTrip(srv, "OPTIONS icap://icap-server.net/other ICAP/1.0\r\n"+
+		"Host: icap-server.net\r\n"+
+		"\r\n", t)
+	if !strings.HasPrefix(response, "ICAP/1.0 404 ICAP Service Not Found\r\n") {
+		t.Fatalf("Response is %s (should be a 404)", response)
+	}
+}
+
+func TestRequestLineTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	srv := &Server{
+		RequestLineTimeout: 50 * time.Millisecond,
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			t.Error("handler called for incomplete request")
+		}),
+	}
+	go srv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer conn.Close()
+
+	// Trickle the request line one byte at a time.
+	go func() {
+		for _, c := range []byte("REQMOD icap://icap-server.net/server ICAP/1.0\r\n") {
+			if _, err := conn.Write([]byte{c}); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	// The server may reset the connection rather than closing it cleanly.
+	response, err := ioutil.ReadAll(conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection was not closed")
+	}
+	if len(response) != 0 {
+		t.Errorf("Response is %s (should be empty)", response)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connection closed after %v (should be about 50ms)", elapsed)
+	}
+}
+
+func TestOnListen(t *testing.T) {
+	addrs := make(chan net.Addr, 1)
+	srv := &Server{
+		Addr: "localhost:0",
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(200, nil, false)
+		}),
+		OnListen: func(a net.Addr) { addrs <- a },
+	}
+	go srv.ListenAndServe()
+
+	var addr net.Addr
+	select {
+	case addr = <-addrs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnListen was not called")
+	}
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("could not connect to %v: %v", addr, err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n")
+	conn.(*net.TCPConn).CloseWrite()
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("error while reading response: %v", err)
+	}
+	if !strings.HasPrefix(string(response), "ICAP/1.0 200 OK\r\n") {
+		t.Fatalf("Response is %s (should be a 200)", response)
+	}
+}
+
+func TestStrictHTTP(t *testing.T) {
+	for _, framing := range []string{
+		"Content-Length: 5\r\nTransfer-Encoding: chunked\r\n",
+		"Content-Length: 5\r\nContent-Length: 5\r\n",
+	} {
+		httpReq := "POST /origin-resource HTTP/1.1\r\n" +
+			"Host: www.origin-server.com\r\n" +
+			framing +
+			"\r\n"
+		request := "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: req-hdr=0, req-body=" + strconv.Itoa(len(httpReq)) + "\r\n" +
+			"\r\n" +
+			httpReq +
+			"5\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"\r\n"
+
+		called := false
+		srv := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+				called = true
+				w.WriteHeader(204, nil, false)
+			}),
+		}
+		serverRoundTrip(srv, request, t)
+		if !called {
+			t.Errorf("request with %q rejected when not strict", framing)
+		}
+
+		srv.StrictHTTP = true
+		called = false
+		response := serverRoundTrip(srv, request, t)
+		if called || !strings.HasPrefix(response, "ICAP/1.0 400 Bad Request\r\n") {
+			t.Errorf("Response to %q is %s (should be a 400)", framing, response)
+		}
+	}
+}
+
+func TestMalformedHTTP(t *testing.T) {
+	request :=
+		"REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: req-hdr=0, null-body=36\r\n" +
+			"\r\n" +
+			"GET\r\n" +
+			"Host: www.origin-server.com\r\n" +
+			"\r\n"
+	response := roundTrip(request, HandlerFunc(func(w ResponseWriter, req *Request) {
+		t.Error("handler called for malformed HTTP request")
+	}), t)
+	if !strings.HasPrefix(response, "ICAP/1.0 400 Bad Request\r\n") {
+		t.Fatalf("Response is %s (should be a 400)", response)
+	}
+}
+
+func TestConnRequestNum(t *testing.T) {
+	response := roundTrip("OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n", HandlerFunc(func(w ResponseWriter, req *Request) {
+		if req.ConnRequestNum != 1 {
+			t.Errorf("ConnRequestNum is %d (should be 1)", req.ConnRequestNum)
+		}
+		w.WriteHeader(200, nil, false)
+	}), t)
+	if !strings.HasPrefix(response, "ICAP/1.0 200 OK\r\n") {
+		t.Fatalf("Response is %s (should be a 200)", response)
+	}
+}
+
+// A chanWriter sends each log message written to it on a channel.
+type chanWriter chan string
+
+func (c chanWriter) Write(p []byte) (int, error) {
+	c <- string(p)
+	return len(p), nil
+}
+
+func TestReadErrorLogging(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	logged := make(chanWriter, 10)
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			t.Error("handler called for incomplete request")
+		}),
+		ErrorLog: log.New(logged, "", 0),
+	}
+	go srv.Serve(l)
+
+	// Closing the connection without sending anything is not an error.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	conn.Close()
+	select {
+	case msg := <-logged:
+		t.Errorf("clean close logged %q", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Closing it in the middle of a request is.
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	io.WriteString(conn, "REQMOD icap://icap-server.net/server ICAP/1.0\r\n")
+	time.Sleep(20 * time.Millisecond)
+	conn.Close()
+	select {
+	case msg := <-logged:
+		if !strings.Contains(msg, "unexpected EOF") {
+			t.Errorf("truncated request logged as %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("truncated request was not logged")
+	}
+
+	// A reset is reported as such.
+	client, server := net.Pipe()
+	defer client.Close()
+	rc := &resetConn{server, strings.NewReader("REQMOD icap://icap-server.net/server ICAP/1.0\r\n")}
+	c, _ := newConn(rc, srv, srv.Handler)
+	go c.serve()
+	select {
+	case msg := <-logged:
+		if !strings.Contains(msg, "connection reset") {
+			t.Errorf("reset logged as %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("reset was not logged")
+	}
+}
+
+// A resetConn returns the contents of r from Read, and then
+// ECONNRESET, as if the peer reset the connection.
+type resetConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *resetConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err == io.EOF {
+		err = &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	}
+	return n, err
+}
+
+func TestDefaultResponseHeaders(t *testing.T) {
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.Header().Set("Service", "Custom")
+			w.WriteHeader(200, nil, false)
+		}),
+		DefaultResponseHeaders: http.Header{
+			"Istag":   {`"DEFAULT"`},
+			"Service": {"Default"},
+		},
+	}
+	response := serverRoundTrip(srv, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n", t)
+	if !strings.Contains(response, "\r\nIstag: \"DEFAULT\"\r\n") {
+		t.Errorf("Response is %s (should have the default ISTag)", response)
+	}
+	if !strings.Contains(response, "\r\nService: Custom\r\n") || strings.Contains(response, "Default") {
+		t.Errorf("Response is %s (should have the handler's Service)", response)
+	}
+}
+
+func TestServerISTag(t *testing.T) {
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			if req.URL.Path == "/override" {
+				w.Header().Set("ISTag", `"HANDLER"`)
+			}
+			w.WriteHeader(204, nil, false)
+		}),
+		ISTag:    `"SERVER-1"`,
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	for _, c := range []struct {
+		request, istag string
+	}{
+		{"OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n", `"SERVER-1"`},
+		{"OPTIONS icap://icap-server.net/override ICAP/1.0\r\n\r\n", `"HANDLER"`},
+		// An error answered by the server itself.
+		{"OPTIONS icap://icap-server.net/server ICAP/1.0\r\nPreview: 1000000000\r\n\r\n", `"SERVER-1"`},
+	} {
+		response := serverRoundTrip(srv, c.request, t)
+		if !strings.Contains(response, "\r\nIstag: "+c.istag+"\r\n") || strings.Count(response, "Istag") != 1 {
+			t.Errorf("Response to %q is %s (should have ISTag %s)", c.request, response, c.istag)
+		}
+	}
+}
+
+func TestMaxAcceptRate(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	srv := &Server{
+		MaxAcceptRate: 20,
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(200, nil, false)
+		}),
+	}
+	go srv.Serve(l)
+
+	// Five connections at 20 per second take at least 200ms to accept.
+	const n = 5
+	start := time.Now()
+	done := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				done <- err
+				return
+			}
+			defer conn.Close()
+			io.WriteString(conn, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n")
+			conn.(*net.TCPConn).CloseWrite()
+			_, err = ioutil.ReadAll(conn)
+			done <- err
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("error in request: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Errorf("%d connections served in %v (should take at least 200ms)", n, elapsed)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	mux := NewServeMux()
+	mux.HandleFunc("/server", func(w ResponseWriter, req *Request) {
+		started <- true
+		<-release
+		w.WriteHeader(204, nil, false)
+	})
+	mux.SetOptions("/options", &Options{Methods: []string{"REQMOD"}})
+	srv := &Server{
+		MaxConnections: 1,
+		AutoOptions:    true,
+		Handler:        mux,
+		ErrorLog:       log.New(ioutil.Discard, "", 0),
+	}
+	go srv.Serve(l)
+
+	busy, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer busy.Close()
+	busy.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(busy, "REQMOD icap://icap-server.net/server ICAP/1.0\r\nEncapsulated: null-body=0\r\n\r\n")
+	<-started
+
+	// A second connection is closed without a response.
+	refused, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer refused.Close()
+	refused.SetDeadline(time.Now().Add(5 * time.Second))
+	if b, err := ioutil.ReadAll(refused); len(b) != 0 || err != nil {
+		t.Errorf("connection over the limit got %q, %v (should be closed)", b, err)
+	}
+
+	release <- true
+	response, err := readResponseHeader(bufio.NewReader(busy))
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	if !strings.HasPrefix(response, "ICAP/1.0 204 No Modifications\r\n") {
+		t.Fatalf("Response is %s (should be a 204)", response)
+	}
+	busy.Close()
+
+	// Once the first connection has gone, the limit is advertised in
+	// OPTIONS responses.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if srv.ActiveConns() == 0 {
+			break
+		}
+	}
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "OPTIONS icap://icap-server.net/options ICAP/1.0\r\n\r\n")
+	if response, err = readResponseHeader(bufio.NewReader(conn)); err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	if !strings.Contains(response, "\r\nMax-Connections: 1\r\n") {
+		t.Errorf("OPTIONS response is %s (should have Max-Connections: 1)", response)
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	srv := &Server{
+		MaxConcurrentRequests: 1,
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			if req.URL.Path == "/slow" {
+				started <- true
+				<-release
+			}
+			w.WriteHeader(204, nil, false)
+		}),
+	}
+	go srv.Serve(l)
+
+	// request may be called from another goroutine, so it doesn't
+	// call t.Fatal.
+	request := func(path string) string {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Errorf("could not connect to ICAP server on localhost")
+			return ""
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "OPTIONS icap://icap-server.net"+path+" ICAP/1.0\r\n\r\n")
+		response, err := readResponseHeader(bufio.NewReader(conn))
+		if err != nil {
+			t.Errorf("error reading response to %s: %v", path, err)
+		}
+		return response
+	}
+
+	slow := make(chan string, 1)
+	go func() { slow <- request("/slow") }()
+	<-started
+
+	if response := request("/fast"); !strings.HasPrefix(response, "ICAP/1.0 503 Service Overloaded\r\n") {
+		t.Errorf("Response while the handler is busy is %s (should be a 503)", response)
+	}
+	release <- true
+	if response := <-slow; !strings.HasPrefix(response, "ICAP/1.0 204 No Modifications\r\n") {
+		t.Errorf("Response from the busy handler is %s (should be a 204)", response)
+	}
+	if response := request("/fast"); !strings.HasPrefix(response, "ICAP/1.0 204 No Modifications\r\n") {
+		t.Errorf("Response once the handler is free is %s (should be a 204)", response)
+	}
+}
+
+func TestPanicHandler(t *testing.T) {
+	type blockError string
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			panic(blockError("forbidden site"))
+		}),
+		PanicHandler: func(w ResponseWriter, req *Request, v interface{}) {
+			if reason, ok := v.(blockError); ok {
+				w.Header().Set("X-Block-Reason", string(reason))
+				w.WriteHeader(403, nil, false)
+			}
+		},
+	}
+	response := serverRoundTrip(srv, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n", t)
+	if !strings.HasPrefix(response, "ICAP/1.0 403 Forbidden\r\n") {
+		t.Fatalf("Response is %s (should be a 403)", response)
+	}
+	if !strings.Contains(response, "\r\nX-Block-Reason: forbidden site\r\n") {
+		t.Errorf("Response is %s (should have X-Block-Reason)", response)
+	}
+}
+
+func TestPanicSends500(t *testing.T) {
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.Header().Set("Methods", "REQMOD")
+			if req.URL.Path == "/started" {
+				w.WriteHeader(200, nil, false)
+			}
+			panic("handler failed")
+		}),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	response := serverRoundTrip(srv, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n", t)
+	if !strings.HasPrefix(response, "ICAP/1.0 500 Server Error\r\n") {
+		t.Fatalf("Response is %s (should be a 500)", response)
+	}
+	if !strings.Contains(response, "\r\nConnection: close\r\n") || strings.Contains(response, "Methods") {
+		t.Errorf("Response is %s (should have Connection: close, and not the handler's headers)", response)
+	}
+
+	// Once the response has started, the connection is just closed.
+	response = serverRoundTrip(srv, "OPTIONS icap://icap-server.net/started ICAP/1.0\r\n\r\n", t)
+	if strings.Contains(response, "500") {
+		t.Errorf("Response is %s (should not have a 500 after the 200)", response)
+	}
+}
+
+func TestStrictResponseValidation(t *testing.T) {
+	for _, c := range []struct {
+		header http.Header
+		status string
+	}{
+		{http.Header{"Istag": {`"1"`}, "Methods": {"REQMOD"}}, "ICAP/1.0 200 OK\r\n"},
+		{http.Header{"Methods": {"REQMOD"}}, "ICAP/1.0 500 Server Error\r\n"},
+		{http.Header{"Istag": {`"1"`}}, "ICAP/1.0 500 Server Error\r\n"},
+	} {
+		srv := &Server{
+			StrictResponseValidation: true,
+			Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+				for k, v := range c.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(200, nil, false)
+			}),
+			ErrorLog: log.New(ioutil.Discard, "", 0),
+		}
+		response := serverRoundTrip(srv, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n", t)
+		if !strings.HasPrefix(response, c.status) {
+			t.Errorf("Response with %v is %s (should be %s)", c.header, response, c.status)
+		}
+	}
+}
+
+// readResponseHeader reads the status line and header of a response
+// with no encapsulated body, and returns them.
+func readResponseHeader(br *bufio.Reader) (string, error) {
+	var resp strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		resp.WriteString(line)
+		if err != nil {
+			return resp.String(), err
+		}
+		if line == "\r\n" {
+			return resp.String(), nil
+		}
+	}
+}
+
+func TestMaxIdleConns(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	srv := &Server{
+		MaxIdleConns: 2,
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(204, nil, false)
+		}),
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	request := "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n"
+	var conns []net.Conn
+	var readers []*bufio.Reader
+	ask := func(i int) error {
+		io.WriteString(conns[i], request)
+		response, err := readResponseHeader(readers[i])
+		if err == nil && !strings.HasPrefix(response, "ICAP/1.0 204 No Modifications\r\n") {
+			t.Fatalf("connection %d: response is %s (should be a 204)", i, response)
+		}
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("could not connect to ICAP server on localhost")
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conns = append(conns, conn)
+		readers = append(readers, bufio.NewReader(conn))
+		if err := ask(i); err != nil {
+			t.Fatalf("connection %d: error while reading response: %v", i, err)
+		}
+		// Let the server mark it idle before the next one is used.
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The connection that has been idle longest was closed.
+	if _, err := readers[0].ReadByte(); err != io.EOF {
+		t.Errorf("oldest idle connection: got %v, want io.EOF", err)
+	}
+	for i := 1; i < 3; i++ {
+		if err := ask(i); err != nil {
+			t.Errorf("connection %d: error while reading response: %v", i, err)
+		}
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	mux := NewServeMux()
+	mux.HandleFunc("/server", func(w ResponseWriter, req *Request) {
+		w.WriteHeader(204, nil, false)
+	})
+	srv := &Server{Handler: mux}
+	go srv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	// A 404 leaves the connection usable, once the unread body is discarded.
+	io.WriteString(conn, "REQMOD icap://icap-server.net/missing ICAP/1.0\r\n"+
+		"Host: icap-server.net\r\n"+
+		"Encapsulated: req-hdr=0, req-body=63\r\n"+
+		"\r\n"+
+		"POST /origin-resource HTTP/1.1\r\n"+
+		"Host: www.origin-server.com\r\n"+
+		"\r\n"+
+		"5\r\n"+
+		"hello\r\n"+
+		"0\r\n"+
+		"\r\n")
+	response, err := readResponseHeader(br)
+	if err != nil {
+		t.Fatalf("error while reading response: %v", err)
+	}
+	if !strings.HasPrefix(response, "ICAP/1.0 404 ICAP Service Not Found\r\n") || strings.Contains(response, "Connection: close") {
+		t.Fatalf("Response is %s (should be a 404 keeping the connection open)", response)
+	}
+
+	io.WriteString(conn, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n")
+	response, err = readResponseHeader(br)
+	if err != nil {
+		t.Fatalf("error while reading response: %v", err)
+	}
+	if !strings.HasPrefix(response, "ICAP/1.0 204 No Modifications\r\n") || strings.Contains(response, "Connection: close") {
+		t.Fatalf("Response is %s (should be a 204 keeping the connection open)", response)
+	}
+
+	// The client can ask for the connection to be closed.
+	io.WriteString(conn, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\nConnection: close\r\n\r\n")
+	rest, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatalf("error while reading response: %v", err)
+	}
+	if !strings.HasPrefix(string(rest), "ICAP/1.0 204 No Modifications\r\n") || !strings.Contains(string(rest), "\r\nConnection: close\r\n") {
+		t.Fatalf("Response is %s (should be a 204 closing the connection)", rest)
+	}
+}
+
+func TestClientConnectionClose(t *testing.T) {
+	options := "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n"
+
+	var mu sync.Mutex
+	calls := 0
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			w.Header().Set("Connection", "keep-alive")
+			w.WriteHeader(204, nil, false)
+		}),
+	}
+
+	// Without "Connection: close", pipelined requests are all answered.
+	response := serverRoundTrip(srv, options+"\r\n"+options+"\r\n", t)
+	if n := strings.Count(response, "ICAP/1.0 204"); n != 2 || strings.Contains(response, "Connection: close") {
+		t.Errorf("Response is %s (should be two 204s keeping the connection open)", response)
+	}
+
+	// The token is matched without regard to case, among others; the
+	// handler's Connection header does not override it, and a request
+	// pipelined after it is not read.
+	mu.Lock()
+	calls = 0
+	mu.Unlock()
+	response = serverRoundTrip(srv, options+"Connection: foo, Close\r\n\r\n"+options+"\r\n", t)
+	if n := strings.Count(response, "ICAP/1.0 204"); n != 1 || !strings.Contains(response, "\r\nConnection: close\r\n") || strings.Contains(response, "keep-alive") {
+		t.Errorf("Response is %s (should be one 204 closing the connection)", response)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("handler called %d times after Connection: close (should be 1)", calls)
+	}
+}
+
+func TestKeepAliveAfterBadRequest(t *testing.T) {
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			t.Error("handler called for bad request")
+		}),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	response := serverRoundTrip(srv, "REQMOD icap://icap-server.net/server ICAP/1.0\r\n"+
+		"Encapsulated: req-hdr=0, null-body=36\r\n"+
+		"\r\n"+
+		"GET\r\n"+
+		"Host: www.origin-server.com\r\n"+
+		"\r\n", t)
+	if !strings.HasPrefix(response, "ICAP/1.0 400 Bad Request\r\n") || !strings.Contains(response, "\r\nConnection: close\r\n") {
+		t.Fatalf("Response is %s (should be a 400 closing the connection)", response)
+	}
+}
+
+func TestActiveConns(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(200, nil, false)
+		}),
+	}
+	go srv.Serve(l)
+
+	// waitFor waits for srv.ActiveConns to reach n.
+	waitFor := func(n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for srv.ActiveConns() != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("ActiveConns is %d (should be %d)", srv.ActiveConns(), n)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("could not connect to ICAP server on localhost")
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	waitFor(3)
+
+	io.WriteString(conns[0], "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n")
+	conns[0].(*net.TCPConn).CloseWrite()
+	ioutil.ReadAll(conns[0])
+	waitFor(2)
+	for _, conn := range conns[1:] {
+		conn.Close()
+	}
+	waitFor(0)
+}
+
+func TestStrictEncapsulated(t *testing.T) {
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			t.Error("handler called for request with no body section")
+		}),
+		StrictEncapsulated: true,
+		ErrorLog:           log.New(ioutil.Discard, "", 0),
+	}
+	response := serverRoundTrip(srv, "REQMOD icap://icap-server.net/server ICAP/1.0\r\n"+
+		"Host: icap-server.net\r\n"+
+		"Encapsulated: req-hdr=0\r\n"+
+		"\r\n"+
+		"GET /origin-resource HTTP/1.1\r\n"+
+		"Host: www.origin-server.com\r\n"+
+		"\r\n", t)
+	if !strings.HasPrefix(response, "ICAP/1.0 400 Bad Request\r\n") {
+		t.Fatalf("Response is %s (should be a 400)", response)
+	}
+}
+
+// A writeCountingListener counts the writes to the connections it accepts.
+type writeCountingListener struct {
+	net.Listener
+	writes chan int
+}
+
+func (l writeCountingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &writeCountingConn{Conn: c, writes: l.writes}, nil
+}
+
+type writeCountingConn struct {
+	net.Conn
+	n      int
+	writes chan int
+}
+
+func (c *writeCountingConn) Write(p []byte) (int, error) {
+	c.n++
+	return c.Conn.Write(p)
+}
+
+func (c *writeCountingConn) Close() error {
+	c.writes <- c.n
+	return c.Conn.Close()
+}
+
+func TestResponseSingleWrite(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	writes := make(chan int, 1)
+	cl := writeCountingListener{l, writes}
+	defer cl.Close()
+	go Serve(cl, HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.Header().Set("X-Large", strings.Repeat("x", 8192))
+		w.WriteHeader(200, req.Request, true)
+		io.WriteString(w, "hello")
+	}))
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer conn.Close()
+	io.WriteString(conn, "REQMOD icap://icap-server.net/server ICAP/1.0\r\n"+
+		"Host: icap-server.net\r\n"+
+		"Encapsulated: req-hdr=0, null-body=62\r\n"+
+		"\r\n"+
+		"GET /origin-resource HTTP/1.1\r\n"+
+		"Host: www.origin-server.com\r\n"+
+		"\r\n")
+	conn.(*net.TCPConn).CloseWrite()
+	ioutil.ReadAll(conn)
+	select {
+	case n := <-writes:
+		// The header is too big for the buffer, so the body goes separately.
+		if n != 2 {
+			t.Errorf("response written in %d writes (should be 2)", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "icap-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(certFile, keyFile, t)
+
+	addrs := make(chan net.Addr, 1)
+	logged := make(chanWriter, 10)
+	srv := &Server{
+		Addr: "localhost:0",
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(200, nil, false)
+		}),
+		OnListen: func(a net.Addr) { addrs <- a },
+		ErrorLog: log.New(logged, "", 0),
+	}
+	go srv.ListenAndServeTLS(certFile, keyFile)
+
+	var addr net.Addr
+	select {
+	case addr = <-addrs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnListen was not called")
+	}
+
+	// A client that doesn't speak TLS is logged and disconnected.
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("could not connect to %v: %v", addr, err)
+	}
+	io.WriteString(conn, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n")
+	select {
+	case msg := <-logged:
+		if !strings.Contains(msg, "TLS handshake error") {
+			t.Errorf("failed handshake logged as %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("failed handshake was not logged")
+	}
+	conn.Close()
+
+	// The server keeps accepting connections after that.
+	tc, err := tls.Dial("tcp", addr.String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("could not connect to %v with TLS: %v", addr, err)
+	}
+	defer tc.Close()
+	io.WriteString(tc, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n")
+	line, err := bufio.NewReader(tc).ReadString('\n')
+	if err != nil {
+		t.Fatalf("error while reading response: %v", err)
+	}
+	checkString("Status line", line, "ICAP/1.0 200 OK\r\n", t)
+}
+
+// writeTestCert writes a self-signed certificate for localhost, and its
+// key, to certFile and keyFile in PEM format.
+func writeTestCert(certFile, keyFile string, t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"go-icap test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	defer l.Close()
+	logged := make(chanWriter, 10)
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(204, nil, false)
+		}),
+		IdleTimeout: 50 * time.Millisecond,
+		ErrorLog:    log.New(logged, "", 0),
+	}
+	go srv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	// The first request may take longer than IdleTimeout to arrive.
+	time.Sleep(100 * time.Millisecond)
+	io.WriteString(conn, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n")
+	response, err := readResponseHeader(br)
+	if err != nil {
+		t.Fatalf("error while reading response: %v", err)
+	}
+	if !strings.HasPrefix(response, "ICAP/1.0 204 No Modifications\r\n") || strings.Contains(response, "Connection: close") {
+		t.Fatalf("Response is %s (should be a 204 keeping the connection open)", response)
+	}
+
+	// But then the connection is closed, without logging an error.
+	start := time.Now()
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("reading from idle connection returned %v (should be EOF)", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("idle connection closed after %v", d)
+	}
+	select {
+	case msg := <-logged:
+		t.Errorf("idle timeout logged %q", msg)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "icap-unix-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "icap.sock")
+
+	listening := make(chan bool, 1)
+	srv := &Server{
+		Network: "unix",
+		Addr:    path,
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(204, nil, false)
+		}),
+		OnListen: func(net.Addr) { listening <- true },
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.ListenAndServe() }()
+	select {
+	case <-listening:
+	case err := <-serveErr:
+		t.Fatalf("ListenAndServe on a Unix socket: %v", err)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("could not connect to %s: %v", path, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n")
+	response, err := readResponseHeader(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	if !strings.HasPrefix(response, "ICAP/1.0 204 No Modifications\r\n") {
+		t.Fatalf("Response is %s (should be a 204)", response)
+	}
+
+	srv.Close()
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Errorf("ListenAndServe returned %v (should be ErrServerClosed)", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left behind after Close")
+	}
+}
+
+func TestBufferSizes(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	c, _ := newConn(server, &Server{}, nil)
+	if c.buf.Reader.Size() != 4096 || c.buf.Writer.Size() != 4096 {
+		t.Errorf("default buffer sizes are %d and %d (should be 4096)", c.buf.Reader.Size(), c.buf.Writer.Size())
+	}
+	c, _ = newConn(server, &Server{ReadBufferSize: 64 << 10, WriteBufferSize: 32 << 10}, nil)
+	if c.buf.Reader.Size() != 64<<10 || c.buf.Writer.Size() != 32<<10 {
+		t.Errorf("buffer sizes are %d and %d (should be %d and %d)", c.buf.Reader.Size(), c.buf.Writer.Size(), 64<<10, 32<<10)
+	}
+
+	// A large body passes through large buffers unchanged.
+	body := strings.Repeat("0123456789abcdef", 10000)
+	request := "RESPMOD icap://icap-server.net/scan ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: res-hdr=0, res-body=45\r\n" +
+		"\r\n" +
+		"HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		strconv.FormatInt(int64(len(body)), 16) + "\r\n" + body + "\r\n0\r\n\r\n"
+	srv := &Server{
+		ReadBufferSize:  64 << 10,
+		WriteBufferSize: 64 << 10,
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(200, req.Response, true)
+			io.Copy(w, req.Response.Body)
+		}),
+	}
+	response := serverRoundTrip(srv, request, t)
+	icapEnd := strings.Index(response, "\r\n\r\n")
+	httpEnd := strings.Index(response[icapEnd+4:], "\r\n\r\n")
+	if icapEnd < 0 || httpEnd < 0 {
+		t.Fatalf("incomplete response: %q", response)
+	}
+	got, err := ioutil.ReadAll(newChunkedReader(strings.NewReader(response[icapEnd+4+httpEnd+4:])))
+	if err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	if string(got) != body {
+		t.Errorf("body is %d bytes (should be the %d bytes sent)", len(got), len(body))
+	}
+}
+
+func TestRemoteNetAddr(t *testing.T) {
+	request := "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+		"Host: icap-server.net\r\n" +
+		"Encapsulated: null-body=0\r\n" +
+		"\r\n"
+
+	var remote, local net.Addr
+	var remoteString string
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			remote, local, remoteString = req.RemoteNetAddr(), req.LocalAddr(), req.RemoteAddr
+			w.WriteHeader(204, nil, false)
+		}),
+	}
+	serverRoundTrip(srv, request, t)
+
+	addr, ok := remote.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("RemoteNetAddr is %T (should be *net.TCPAddr)", remote)
+	}
+	if !addr.IP.IsLoopback() {
+		t.Errorf("remote IP is %v (should be a loopback address)", addr.IP)
+	}
+	checkString("RemoteAddr", remoteString, addr.String(), t)
+	if laddr, ok := local.(*net.TCPAddr); !ok || !laddr.IP.IsLoopback() {
+		t.Errorf("LocalAddr is %v (should be a loopback address)", local)
+	}
+
+	var req Request
+	if req.RemoteNetAddr() != nil || req.LocalAddr() != nil {
+		t.Errorf("addresses of a Request not from a Server are %v and %v (should be nil)", req.RemoteNetAddr(), req.LocalAddr())
+	}
+}
+
+// A connRecordingListener passes on each connection it accepts.
+type connRecordingListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l connRecordingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.conns <- c
+	}
+	return c, err
+}
+
+// noDelay reports whether TCP_NODELAY is set on c.
+func noDelay(c net.Conn, t *testing.T) bool {
+	sc, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	if err := sc.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return v != 0
+}
+
+func TestDisableNoDelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "icap-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(certFile, keyFile, t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		disable, useTLS bool
+	}{
+		{false, false},
+		{true, false},
+		{false, true},
+		{true, true},
+	} {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("could not listen on localhost: %v", err)
+		}
+		conns := make(chan net.Conn, 1)
+		var sl net.Listener = connRecordingListener{l, conns}
+		if c.useTLS {
+			sl = tls.NewListener(sl, &tls.Config{Certificates: []tls.Certificate{cert}})
+		}
+		srv := &Server{
+			DisableNoDelay: c.disable,
+			Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+				w.WriteHeader(200, nil, false)
+			}),
+		}
+		go srv.Serve(sl)
+
+		var conn net.Conn
+		if c.useTLS {
+			conn, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		} else {
+			conn, err = net.Dial("tcp", l.Addr().String())
+		}
+		if err != nil {
+			t.Fatalf("could not connect: %v", err)
+		}
+		io.WriteString(conn, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n")
+		if _, err := readResponseHeader(bufio.NewReader(conn)); err != nil {
+			t.Fatalf("error while reading response: %v", err)
+		}
+		if got := noDelay(<-conns, t); got == c.disable {
+			t.Errorf("TCP_NODELAY is %v with DisableNoDelay %v (TLS %v)", got, c.disable, c.useTLS)
+		}
+		conn.Close()
+		sl.Close()
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Stopping a Server.
+
+package icap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve, ListenAndServe, and
+// ListenAndServeTLS after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("icap: Server closed")
+
+// shutdownPollInterval is how often Shutdown checks whether the
+// server's connections have finished their requests.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown stops the server without interrupting any requests: it closes
+// its listeners, then closes connections as they become idle (waiting
+// for a request), and returns once they are all closed and the
+// goroutines serving them have finished, so that ActiveConns is 0.
+// Responses sent meanwhile have "Connection: close". If ctx expires
+// first, Shutdown returns its error, leaving the remaining connections
+// open.
+//
+// Serve returns ErrServerClosed as soon as Shutdown is called. The
+// server may not be reused afterwards.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+
+	srv.mu.Lock()
+	err := srv.closeListenersLocked()
+	srv.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if srv.closeIdleConns() && srv.ActiveConns() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the server at once, closing its listeners and all its
+// connections, even those in the middle of a request. For a graceful
+// stop, use Shutdown.
+func (srv *Server) Close() error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	err := srv.closeListenersLocked()
+	for c := range srv.conns {
+		c.closeNow()
+		delete(srv.conns, c)
+	}
+	return err
+}
+
+func (srv *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) != 0
+}
+
+// trackListener adds l to the set of listeners closed by Shutdown and
+// Close, or removes it. It returns false if l cannot be added because
+// the server is shutting down.
+func (srv *Server) trackListener(l net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
+		if srv.shuttingDown() {
+			return false
+		}
+		if srv.listeners == nil {
+			srv.listeners = make(map[net.Listener]struct{})
+		}
+		srv.listeners[l] = struct{}{}
+	} else {
+		delete(srv.listeners, l)
+	}
+	return true
+}
+
+func (srv *Server) trackConn(c *conn, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
+		if srv.conns == nil {
+			srv.conns = make(map[*conn]struct{})
+		}
+		srv.conns[c] = struct{}{}
+	} else {
+		delete(srv.conns, c)
+		srv.removeIdleConnLocked(c)
+	}
+}
+
+// addIdleConn records that c is waiting for its next request, and
+// closes the connections that have been idle longest beyond
+// srv.MaxIdleConns.
+func (srv *Server) addIdleConn(c *conn) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.idleConns = append(srv.idleConns, c)
+	for len(srv.idleConns) > srv.MaxIdleConns {
+		oldest := srv.idleConns[0]
+		srv.idleConns[0] = nil
+		srv.idleConns = srv.idleConns[1:]
+		if oldest.closeIfIdle() {
+			delete(srv.conns, oldest)
+		}
+	}
+}
+
+func (srv *Server) removeIdleConn(c *conn) {
+	srv.mu.Lock()
+	srv.removeIdleConnLocked(c)
+	srv.mu.Unlock()
+}
+
+func (srv *Server) removeIdleConnLocked(c *conn) {
+	for i, ic := range srv.idleConns {
+		if ic == c {
+			copy(srv.idleConns[i:], srv.idleConns[i+1:])
+			srv.idleConns[len(srv.idleConns)-1] = nil
+			srv.idleConns = srv.idleConns[:len(srv.idleConns)-1]
+			return
+		}
+	}
+}
+
+func (srv *Server) closeListenersLocked() error {
+	var err error
+	for l := range srv.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// closeIdleConns closes the connections that are waiting for a request,
+// and reports whether there are no connections left.
+func (srv *Server) closeIdleConns() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	quiescent := true
+	for c := range srv.conns {
+		if c.closeIfIdle() {
+			delete(srv.conns, c)
+		} else {
+			quiescent = false
+		}
+	}
+	return quiescent
+}
+
+// A connState is the state of a conn, for Shutdown.
+type connState int
+
+const (
+	stateIdle   connState = iota // waiting for a request
+	stateActive                  // reading or answering a request
+	stateClosed                  // closed by Shutdown or Close
+)
+
+// markActive marks the connection as busy with a request. It returns
+// net.ErrClosed if the connection has been closed by Shutdown or Close.
+func (c *conn) markActive() error {
+	c.mu.Lock()
+	if c.state == stateClosed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.state = stateActive
+	c.mu.Unlock()
+	if c.requests > 0 && c.server.MaxIdleConns > 0 {
+		c.server.removeIdleConn(c)
+	}
+	return nil
+}
+
+// markIdle marks the connection as waiting for a request. Once it has
+// answered one, it counts towards the server's MaxIdleConns.
+func (c *conn) markIdle() {
+	c.mu.Lock()
+	idle := c.state != stateClosed
+	if idle {
+		c.state = stateIdle
+	}
+	c.mu.Unlock()
+	if idle && c.requests > 0 && c.server.MaxIdleConns > 0 {
+		c.server.addIdleConn(c)
+	}
+}
+
+// closeIfIdle closes the connection if it is waiting for a request,
+// and reports whether it is closed.
+func (c *conn) closeIfIdle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != stateIdle {
+		return c.state == stateClosed
+	}
+	c.state = stateClosed
+	c.cr.rwc.Close()
+	return true
+}
+
+func (c *conn) closeNow() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = stateClosed
+	c.cr.rwc.Close()
+}
@@ -0,0 +1,204 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startBlockingServer starts a Server whose handler signals on started
+// and then waits for release before answering with a 204.
+func startBlockingServer(t *testing.T) (srv *Server, addr string, serveErr chan error, started, release chan bool) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	started = make(chan bool, 1)
+	release = make(chan bool)
+	srv = &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			started <- true
+			<-release
+			w.WriteHeader(204, nil, false)
+		}),
+	}
+	serveErr = make(chan error, 1)
+	go func() { serveErr <- srv.Serve(l) }()
+	return srv, l.Addr().String(), serveErr, started, release
+}
+
+func TestShutdown(t *testing.T) {
+	srv, addr, serveErr, started, release := startBlockingServer(t)
+
+	// An idle connection is closed.
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer idle.Close()
+
+	busy, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer busy.Close()
+	busy.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(busy, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n")
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- srv.Shutdown(context.Background()) }()
+
+	select {
+	case err := <-serveErr:
+		if err != ErrServerClosed {
+			t.Errorf("Serve returned %v (should be ErrServerClosed)", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("connection accepted after Shutdown")
+	}
+	idle.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("reading from idle connection returned %v (should be EOF)", err)
+	}
+
+	// The request in progress is finished.
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned %v with a request in progress", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	response, err := ioutil.ReadAll(busy)
+	if err != nil {
+		t.Fatalf("error while reading response: %v", err)
+	}
+	if !strings.HasPrefix(string(response), "ICAP/1.0 204 No Modifications\r\n") || !strings.Contains(string(response), "\r\nConnection: close\r\n") {
+		t.Fatalf("Response is %s (should be a 204 closing the connection)", response)
+	}
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Errorf("Shutdown returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	srv, addr, _, started, release := startBlockingServer(t)
+	defer close(release)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer conn.Close()
+	io.WriteString(conn, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v (should be %v)", err, context.DeadlineExceeded)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	srv, addr, serveErr, started, release := startBlockingServer(t)
+	defer close(release)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n")
+	<-started
+
+	if err := srv.Close(); err != nil {
+		t.Errorf("Close returned %v", err)
+	}
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Errorf("Serve returned %v (should be ErrServerClosed)", err)
+	}
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != io.EOF {
+		t.Errorf("reading from connection in the middle of a request returned %v (should be EOF)", err)
+	}
+	if err := srv.ListenAndServe(); err != ErrServerClosed {
+		t.Errorf("ListenAndServe after Close returned %v (should be ErrServerClosed)", err)
+	}
+}
+
+// A slowCloseListener's connections take a while to notice that they
+// have been closed.
+type slowCloseListener struct {
+	net.Listener
+}
+
+func (l slowCloseListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return slowCloseConn{c}, nil
+}
+
+type slowCloseConn struct {
+	net.Conn
+}
+
+func (c slowCloseConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return n, err
+}
+
+func TestShutdownWaitsForConnGoroutines(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen on localhost: %v", err)
+	}
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(204, nil, false)
+		}),
+	}
+	go srv.Serve(slowCloseListener{l})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to ICAP server on localhost")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "OPTIONS icap://icap-server.net/server ICAP/1.0\r\n\r\n")
+	if _, err := readResponseHeader(bufio.NewReader(conn)); err != nil {
+		t.Fatalf("error while reading response: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown returned %v", err)
+	}
+	if n := srv.ActiveConns(); n != 0 {
+		t.Errorf("ActiveConns is %d after Shutdown returned (should be 0)", n)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Buffering bodies for random access.
+
+package icap
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// SpillBody reads the encapsulated body into a buffer that supports
+// seeking, for scanners that need random access to the whole body.
+// A body of up to threshold bytes is kept in memory; a larger one is
+// written to a temporary file.
+//
+// The Server removes the temporary file when it has finished with the
+// request, even if the handler panics. If req did not come from a
+// Server, the reader is an *os.File that the caller must close and remove.
+func (req *Request) SpillBody(threshold int64) (io.ReadSeeker, error) {
+	body := req.Body()
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, body, threshold+1)
+	if err == io.EOF {
+		return bytes.NewReader(buf.Bytes()), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile("", "icap-body-")
+	if err != nil {
+		return nil, err
+	}
+	if req.tempFiles == nil {
+		req.tempFiles = new([]*os.File)
+	}
+	*req.tempFiles = append(*req.tempFiles, f)
+	if _, err = buf.WriteTo(f); err == nil {
+		_, err = io.Copy(f, body)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		// The caller gets no handle to the file, so don't leave it
+		// for anyone to clean up.
+		files := *req.tempFiles
+		*req.tempFiles = files[:len(files)-1]
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// removeTempFiles closes and removes the files created by SpillBody.
+func (req *Request) removeTempFiles() {
+	if req.tempFiles == nil {
+		return
+	}
+	for _, f := range *req.tempFiles {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	*req.tempFiles = nil
+}
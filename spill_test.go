@@ -0,0 +1,119 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+const spillRequest = "REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+	"Host: icap-server.net\r\n" +
+	"Encapsulated: req-hdr=0, req-body=63\r\n" +
+	"\r\n" +
+	"POST /origin-resource HTTP/1.1\r\n" +
+	"Host: www.origin-server.com\r\n" +
+	"\r\n" +
+	"5\r\n" +
+	"hello\r\n" +
+	"6\r\n" +
+	" world\r\n" +
+	"0\r\n" +
+	"\r\n"
+
+func TestSpillBodyInMemory(t *testing.T) {
+	req, err := ReadRequest(newTestReadWriter(spillRequest))
+	if err != nil {
+		t.Fatalf("error while reading request: %v", err)
+	}
+	r, err := req.SpillBody(100)
+	if err != nil {
+		t.Fatalf("SpillBody: %v", err)
+	}
+	if _, ok := r.(*os.File); ok {
+		t.Error("small body was written to a file")
+	}
+	r.Seek(6, io.SeekStart)
+	rest, _ := ioutil.ReadAll(r)
+	checkString("Body after seeking", string(rest), "world", t)
+}
+
+func TestSpillBodyToFile(t *testing.T) {
+	for _, panics := range []bool{false, true} {
+		names := make(chan string, 1)
+		srv := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+				r, err := req.SpillBody(4)
+				if err != nil {
+					t.Errorf("SpillBody: %v", err)
+					return
+				}
+				f, ok := r.(*os.File)
+				if !ok {
+					t.Error("large body was not written to a file")
+					return
+				}
+				names <- f.Name()
+				r.Seek(6, io.SeekStart)
+				rest, _ := ioutil.ReadAll(r)
+				checkString("Body after seeking", string(rest), "world", t)
+				if panics {
+					panic("scanner failed")
+				}
+				w.WriteHeader(204, nil, false)
+			}),
+			ErrorLog: log.New(ioutil.Discard, "", 0),
+		}
+		serverRoundTrip(srv, spillRequest, t)
+
+		name := <-names
+		deadline := time.Now().Add(time.Second)
+		for {
+			if _, err := os.Stat(name); os.IsNotExist(err) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("temporary file not removed (panic: %v)", panics)
+				os.Remove(name)
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestSpillBodyError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "icap-spill-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldTmp := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", dir)
+	defer os.Setenv("TMPDIR", oldTmp)
+
+	// The connection ends in the middle of the body.
+	req, err := ReadRequest(newTestReadWriter(spillRequest[:len(spillRequest)-len("0\r\n\r\n")]))
+	if err != nil {
+		t.Fatalf("error while reading request: %v", err)
+	}
+	if _, err := req.SpillBody(4); err == nil {
+		t.Fatal("SpillBody succeeded on a truncated body")
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("%d temporary files left behind after an error", len(files))
+	}
+	if len(*req.tempFiles) != 0 {
+		t.Errorf("failed file still listed for removal")
+	}
+}
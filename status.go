@@ -10,21 +10,47 @@ import (
 	"net/http"
 )
 
+// ICAP status codes, from RFC 3507, section 4.3.3, and the Allow: 206
+// extension. ICAP also uses the HTTP status codes that are not listed
+// here, with their HTTP meanings.
+const (
+	StatusContinue                = 100
+	StatusOK                      = 200
+	StatusNoModifications         = 204
+	StatusPartialContent          = 206
+	StatusBadRequest              = 400
+	StatusForbidden               = 403
+	StatusServiceNotFound         = 404
+	StatusMethodNotAllowed        = 405
+	StatusRequestTimeout          = 408
+	StatusBadComposition          = 418
+	StatusServerError             = 500
+	StatusMethodNotImplemented    = 501
+	StatusBadGateway              = 502
+	StatusServiceOverloaded       = 503
+	StatusICAPVersionNotSupported = 505
+
+	// StatusNoContentNeeded is another name for StatusNoModifications.
+	StatusNoContentNeeded = StatusNoModifications
+)
+
 var statusText = map[int]string{
-	100: "Continue",
-	204: "No Modifications",
-	400: "Bad Request",
-	404: "ICAP Service Not Found",
-	405: "Method Not Allowed",
-	408: "Request Timeout",
-	500: "Server Error",
-	501: "Method Not Implemented",
-	502: "Bad Gateway",
-	503: "Service Overloaded",
-	505: "ICAP Version Not Supported",
+	StatusContinue:                "Continue",
+	StatusNoModifications:         "No Modifications",
+	StatusBadRequest:              "Bad Request",
+	StatusServiceNotFound:         "ICAP Service Not Found",
+	StatusMethodNotAllowed:        "Method Not Allowed",
+	StatusRequestTimeout:          "Request Timeout",
+	StatusBadComposition:          "Bad Composition",
+	StatusServerError:             "Server Error",
+	StatusMethodNotImplemented:    "Method Not Implemented",
+	StatusBadGateway:              "Bad Gateway",
+	StatusServiceOverloaded:       "Service Overloaded",
+	StatusICAPVersionNotSupported: "ICAP Version Not Supported",
 }
 
 // StatusText returns a text for the ICAP status code. It returns the empty string if the code is unknown.
+// Codes that mean the same in ICAP as in HTTP get their HTTP text.
 func StatusText(code int) string {
 	text, ok := statusText[code]
 	if ok {
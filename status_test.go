@@ -18,4 +18,7 @@ func TestStatusCodes(t *testing.T) {
 	checkString("Message", StatusText(100), "Continue", t)
 	checkString("Message", StatusText(401), "Unauthorized", t)
 	checkString("Status-not-found message", StatusText(12345), "", t)
+	checkString("Message", StatusText(StatusBadComposition), "Bad Composition", t)
+	checkString("Message", StatusText(StatusPartialContent), "Partial Content", t)
+	checkString("Message", StatusText(StatusNoContentNeeded), "No Modifications", t)
 }
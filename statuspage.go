@@ -0,0 +1,62 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Status pages returned to the user in place of the adapted HTTP message.
+
+package icap
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+// A StatusPageSet holds an HTML template for each HTTP status code that
+// a service wants to return with branded content, such as a page
+// explaining that a site is blocked. The page is sent as an encapsulated
+// HTTP response, so it satisfies a REQMOD request or replaces the
+// response in RESPMOD.
+type StatusPageSet struct {
+	pages map[int]*template.Template
+}
+
+// NewStatusPageSet allocates and returns a new, empty StatusPageSet.
+func NewStatusPageSet() *StatusPageSet {
+	return &StatusPageSet{make(map[int]*template.Template)}
+}
+
+// Add registers the template for the HTTP status code code.
+func (s *StatusPageSet) Add(code int, tmpl *template.Template) {
+	s.pages[code] = tmpl
+}
+
+// Write renders the page for code with data and sends it to w as the
+// body of an HTTP response with that status. If no template is
+// registered for code, a minimal page with the status text is sent.
+func (s *StatusPageSet) Write(w ResponseWriter, code int, data interface{}) error {
+	body := new(bytes.Buffer)
+	if tmpl := s.pages[code]; tmpl != nil {
+		if err := tmpl.Execute(body, data); err != nil {
+			return err
+		}
+	} else {
+		text := template.HTMLEscapeString(http.StatusText(code))
+		body.WriteString("<html><body><h1>" + strconv.Itoa(code) + " " + text + "</h1></body></html>\n")
+	}
+
+	brw := NewBridgedResponseWriter(w)
+	brw.WriteHeader(code)
+	_, err := brw.Write(body.Bytes())
+	return err
+}
+
+// Handler returns a request handler that replies to each request
+// with the page for code. The template is executed with the *Request
+// as its data.
+func (s *StatusPageSet) Handler(code int) Handler {
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		s.Write(w, code, req)
+	})
+}
@@ -0,0 +1,36 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"html/template"
+	"strings"
+	"testing"
+)
+
+func TestStatusPageSet(t *testing.T) {
+	request :=
+		"REQMOD icap://icap-server.net/server ICAP/1.0\r\n" +
+			"Host: icap-server.net\r\n" +
+			"Encapsulated: req-hdr=0, null-body=51\r\n" +
+			"\r\n" +
+			"GET /index.html HTTP/1.1\r\n" +
+			"Host: www.example.com\r\n" +
+			"\r\n"
+
+	pages := NewStatusPageSet()
+	pages.Add(403, template.Must(template.New("blocked").Parse("{{.Request.Host}} is blocked")))
+
+	response := roundTrip(request, pages.Handler(403), t)
+	if !strings.HasPrefix(response, "ICAP/1.0 200 OK\r\n") {
+		t.Fatalf("Response is %s (should be ICAP 200)", response)
+	}
+	if !strings.Contains(response, "\r\n\r\nHTTP/1.1 403 Forbidden\r\n") {
+		t.Fatalf("Response is %s (should contain an HTTP 403)", response)
+	}
+	if !strings.Contains(response, "www.example.com is blocked") {
+		t.Fatalf("Response is %s (should contain the status page)", response)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Checking that requests carry the encapsulated sections a service expects.
+
+package icap
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// A SectionSet lists Encapsulated sections (req-hdr, res-hdr, req-body,
+// res-body, opt-body, or null-body) that a request must have, and ones
+// that it must not have.
+type SectionSet struct {
+	Required  []string
+	Forbidden []string
+}
+
+// An EncapsulationSpec gives the SectionSet for each ICAP method a
+// service accepts. Methods that are not listed are not checked.
+type EncapsulationSpec map[string]SectionSet
+
+// Validate checks that the Encapsulated sections of req match spec.
+// The error describes the first section that is missing or not allowed;
+// the request should be answered with 400 Bad Request.
+func (req *Request) Validate(spec EncapsulationSpec) error {
+	set, ok := spec[req.Method]
+	if !ok {
+		return nil
+	}
+	for _, s := range set.Required {
+		if !req.hasSection(s) {
+			return fmt.Errorf("icap: %s request is missing %s section", req.Method, s)
+		}
+	}
+	for _, s := range set.Forbidden {
+		if req.hasSection(s) {
+			return fmt.Errorf("icap: %s request must not have %s section", req.Method, s)
+		}
+	}
+	return nil
+}
+
+// hasSection reports whether req had the Encapsulated section named s.
+func (req *Request) hasSection(s string) bool {
+	switch s {
+	case "req-hdr":
+		return req.Request != nil
+	case "res-hdr":
+		return req.Response != nil
+	}
+	return req.bodySection == s
+}
+
+// Handler returns a request handler that answers requests that do not
+// match spec with 400 Bad Request, and passes the others to h.
+func (spec EncapsulationSpec) Handler(h Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		if err := req.Validate(spec); err != nil {
+			w.WriteHeader(http.StatusBadRequest, nil, false)
+			return
+		}
+		h.ServeICAP(w, req)
+	})
+}
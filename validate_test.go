@@ -0,0 +1,34 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"testing"
+)
+
+var respmodSpec = EncapsulationSpec{
+	"RESPMOD": {Required: []string{"res-hdr", "res-body"}},
+	"REQMOD":  {Forbidden: []string{"res-hdr"}},
+}
+
+func TestValidate(t *testing.T) {
+	req, err := ReadRequest(newTestReadWriter(reqmodNoBody))
+	if err != nil {
+		t.Fatalf("error reading request: %v", err)
+	}
+	if err := req.Validate(respmodSpec); err != nil {
+		t.Errorf("valid REQMOD rejected: %v", err)
+	}
+
+	req.Method = "RESPMOD"
+	if err := req.Validate(respmodSpec); err == nil {
+		t.Error("RESPMOD without res-hdr accepted")
+	}
+
+	req.Method = "OPTIONS"
+	if err := req.Validate(respmodSpec); err != nil {
+		t.Errorf("unlisted method rejected: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The X- headers that proxies send to describe the transaction.
+
+package icap
+
+import (
+	"net"
+	"strings"
+)
+
+// ClientIP returns the address of the user's computer, from the
+// X-Client-IP header, or nil if there is none or it is malformed.
+func (req *Request) ClientIP() net.IP {
+	return parseIPHeader(req.Header.Get("X-Client-IP"))
+}
+
+// ServerIP returns the address of the origin server, from the
+// X-Server-IP header, or nil if there is none or it is malformed.
+func (req *Request) ServerIP() net.IP {
+	return parseIPHeader(req.Header.Get("X-Server-IP"))
+}
+
+// SubscriberID returns the X-Subscriber-ID header, which identifies
+// the subscriber in ISP deployments, or "" if there is none.
+func (req *Request) SubscriberID() string {
+	return strings.TrimSpace(req.Header.Get("X-Subscriber-ID"))
+}
+
+// parseIPHeader parses an IP address header. Some proxies add a port,
+// or put an IPv6 address in brackets.
+func parseIPHeader(v string) net.IP {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return nil
+	}
+	if ip := net.ParseIP(v); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(v); err == nil {
+		v = host
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(v, "["), "]"))
+}
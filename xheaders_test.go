@@ -0,0 +1,44 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"net"
+	"net/textproto"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		ip     net.IP
+	}{
+		{"192.0.2.1", net.ParseIP("192.0.2.1")},
+		{" 192.0.2.1 ", net.ParseIP("192.0.2.1")},
+		{"192.0.2.1:3128", net.ParseIP("192.0.2.1")},
+		{"2001:db8::1", net.ParseIP("2001:db8::1")},
+		{"[2001:db8::1]", net.ParseIP("2001:db8::1")},
+		{"[2001:db8::1]:3128", net.ParseIP("2001:db8::1")},
+		{"", nil},
+		{"unknown", nil},
+	} {
+		req := &Request{Header: textproto.MIMEHeader{}}
+		req.Header.Set("X-Client-IP", c.header)
+		req.Header.Set("X-Server-IP", c.header)
+		if ip := req.ClientIP(); !ip.Equal(c.ip) {
+			t.Errorf("ClientIP for %q is %v (should be %v)", c.header, ip, c.ip)
+		}
+		if ip := req.ServerIP(); !ip.Equal(c.ip) {
+			t.Errorf("ServerIP for %q is %v (should be %v)", c.header, ip, c.ip)
+		}
+	}
+}
+
+func TestSubscriberID(t *testing.T) {
+	req := &Request{Header: textproto.MIMEHeader{}}
+	checkString("SubscriberID", req.SubscriberID(), "", t)
+	req.Header.Set("X-Subscriber-ID", "sub-42")
+	checkString("SubscriberID", req.SubscriberID(), "sub-42", t)
+}